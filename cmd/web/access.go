@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// accessHandler blocks clients the access rules of a route don't let in,
+// going by the client address forwarded by trusted proxies.
+type accessHandler struct {
+	next    http.Handler
+	service string
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+	blocked *atomic.Uint64
+	logger  *slog.Logger
+}
+
+// accessRule is a models.AccessRule with its ranges parsed.
+type accessRule struct {
+	host     string
+	allow    bool
+	prefixes []netip.Prefix
+}
+
+func compileAccessRules(rules []models.AccessRule) ([]accessRule, error) {
+	parsed := make([]accessRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Action != models.ACCESS_ALLOW && rule.Action != models.ACCESS_DENY {
+			return nil, fmt.Errorf("unknown access rule action %q", rule.Action)
+		}
+		prefixes, err := parsePrefixes(rule.Ranges)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, accessRule{host: rule.Host, allow: rule.Action == models.ACCESS_ALLOW, prefixes: prefixes})
+	}
+	return parsed, nil
+}
+
+// withAccessRules wraps next if any of the rules apply to host. Blocked
+// requests are counted in blocked.
+func withAccessRules(next http.Handler, service, host string, rules []accessRule, blocked *atomic.Uint64, logger *slog.Logger) http.Handler {
+	h := &accessHandler{next: next, service: service, blocked: blocked, logger: logger}
+	for _, rule := range rules {
+		switch {
+		case rule.host != "" && !samePattern(rule.host, host):
+		case rule.allow:
+			h.allow = append(h.allow, rule.prefixes...)
+		default:
+			h.deny = append(h.deny, rule.prefixes...)
+		}
+	}
+
+	if len(h.allow) == 0 && len(h.deny) == 0 {
+		return next
+	}
+	return h
+}
+
+func (h *accessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if containsIP(h.deny, ip) || (len(h.allow) > 0 && !containsIP(h.allow, ip)) {
+		h.blocked.Add(1)
+		h.logger.Info("blocked request", "service", h.service, "client", ip, "host", r.Host, "path", r.URL.Path)
+		renderProxyError(w, r, http.StatusForbidden)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
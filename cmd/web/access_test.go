@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestAccessRules(t *testing.T) {
+	app := newTestApp(t, "10.0.0.0/8")
+	allow := func(host string, ranges ...string) models.AccessRule {
+		return models.AccessRule{Action: models.ACCESS_ALLOW, Ranges: ranges, Host: host}
+	}
+	deny := func(host string, ranges ...string) models.AccessRule {
+		return models.AccessRule{Action: models.ACCESS_DENY, Ranges: ranges, Host: host}
+	}
+
+	tests := []struct {
+		name   string
+		rules  []models.AccessRule
+		peer   string
+		header http.Header
+		want   int
+	}{
+		{name: "no rules", peer: "203.0.113.5", want: http.StatusOK},
+		{name: "allowed", rules: []models.AccessRule{allow("", "203.0.113.0/24")}, peer: "203.0.113.5", want: http.StatusOK},
+		{name: "not allowed", rules: []models.AccessRule{allow("", "203.0.113.0/24")}, peer: "198.51.100.7", want: http.StatusForbidden},
+		{name: "denied", rules: []models.AccessRule{deny("", "203.0.113.5")}, peer: "203.0.113.5", want: http.StatusForbidden},
+		{name: "not denied", rules: []models.AccessRule{deny("", "203.0.113.5")}, peer: "203.0.113.6", want: http.StatusOK},
+		{
+			name:  "deny after allow",
+			rules: []models.AccessRule{allow("", "203.0.113.0/24"), deny("", "203.0.113.5")},
+			peer:  "203.0.113.5",
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "deny before allow",
+			rules: []models.AccessRule{deny("", "203.0.113.5"), allow("", "203.0.113.0/24")},
+			peer:  "203.0.113.5",
+			want:  http.StatusForbidden,
+		},
+		{
+			name:  "allowed next to a denied address",
+			rules: []models.AccessRule{deny("", "203.0.113.5"), allow("", "203.0.113.0/24")},
+			peer:  "203.0.113.6",
+			want:  http.StatusOK,
+		},
+		{name: "ipv6 allowed", rules: []models.AccessRule{allow("", "2001:db8::/32")}, peer: "2001:db8::1", want: http.StatusOK},
+		{name: "ipv6 not allowed", rules: []models.AccessRule{allow("", "2001:db8::/32")}, peer: "2001:db9::1", want: http.StatusForbidden},
+		{name: "ipv6 denied", rules: []models.AccessRule{deny("", "2001:db8::/64")}, peer: "2001:db8::1", want: http.StatusForbidden},
+		{name: "rule for another host", rules: []models.AccessRule{deny("other.com", "203.0.113.5")}, peer: "203.0.113.5", want: http.StatusOK},
+		{name: "rule for this host", rules: []models.AccessRule{deny("example.com", "203.0.113.5")}, peer: "203.0.113.5", want: http.StatusForbidden},
+		{name: "rule for this host in capitals", rules: []models.AccessRule{deny("Example.COM", "203.0.113.5")}, peer: "203.0.113.5", want: http.StatusForbidden},
+		{
+			name:   "client behind a trusted proxy",
+			rules:  []models.AccessRule{deny("", "198.51.100.7")},
+			peer:   "10.0.0.2",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "trusted proxy itself not allowed",
+			rules:  []models.AccessRule{allow("", "198.51.100.0/24")},
+			peer:   "10.0.0.2",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			want:   http.StatusOK,
+		},
+		{
+			name:   "spoofed address from an untrusted peer",
+			rules:  []models.AccessRule{allow("", "198.51.100.0/24")},
+			peer:   "203.0.113.5",
+			header: http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-Ip": {"198.51.100.7"}},
+			want:   http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileAccessRules(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var blocked atomic.Uint64
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h := withAccessRules(next, "test", "example.com", rules, &blocked, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, app.setForwardedHeaders(requestFrom(tt.peer, tt.header), ""))
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d; want %d", w.Code, tt.want)
+			}
+			want := uint64(0)
+			if tt.want == http.StatusForbidden {
+				want = 1
+			}
+			if got := blocked.Load(); got != want {
+				t.Errorf("blocked = %d; want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCompileAccessRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    models.AccessRule
+		wantErr bool
+	}{
+		{name: "allow", rule: models.AccessRule{Action: models.ACCESS_ALLOW, Ranges: []string{"10.0.0.0/8", "2001:db8::/32"}}},
+		{name: "deny", rule: models.AccessRule{Action: models.ACCESS_DENY, Ranges: []string{"10.0.0.1"}}},
+		{name: "unknown action", rule: models.AccessRule{Action: "block", Ranges: []string{"10.0.0.1"}}, wantErr: true},
+		{name: "invalid range", rule: models.AccessRule{Action: models.ACCESS_DENY, Ranges: []string{"10.0.0.0/40"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileAccessRules([]models.AccessRule{tt.rule})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("compileAccessRules() error = %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const forwardAuthTimeout = 10 * time.Second
+
+// withAuth wraps next with the service's auth gate if it protects host.
+func withAuth(next http.Handler, host string, gate models.AuthGate, logger *slog.Logger) http.Handler {
+	if len(gate.Hosts) > 0 && !hasPattern(gate.Hosts, host) {
+		return next
+	}
+
+	switch gate.Mode {
+	case models.AUTH_BASIC:
+		return newBasicAuthHandler(next, gate)
+	case models.AUTH_FORWARD:
+		return newForwardAuthHandler(next, gate, logger)
+	}
+	return next
+}
+
+// basicAuthHandler lets through clients with the credentials of one of its
+// users.
+type basicAuthHandler struct {
+	next  http.Handler
+	realm string
+	users map[string][]byte
+
+	// bcrypt is slow on purpose, so credentials that checked out once are
+	// remembered by a digest instead of being verified on every request
+	mu       sync.RWMutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func newBasicAuthHandler(next http.Handler, gate models.AuthGate) *basicAuthHandler {
+	h := &basicAuthHandler{
+		next:     next,
+		realm:    gate.Realm,
+		users:    make(map[string][]byte, len(gate.Users)),
+		verified: map[[sha256.Size]byte]bool{},
+	}
+	if h.realm == "" {
+		h.realm = "Restricted"
+	}
+	for _, user := range gate.Users {
+		h.users[user.Username] = []byte(user.PasswordHash)
+	}
+	return h
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || !h.check(username, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, h.realm))
+		renderProxyError(w, r, http.StatusUnauthorized)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func (h *basicAuthHandler) check(username, password string) bool {
+	hash, ok := h.users[username]
+	if !ok {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(username + "\x00" + password))
+	h.mu.RLock()
+	verified := h.verified[digest]
+	h.mu.RUnlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.mu.Lock()
+	h.verified[digest] = true
+	h.mu.Unlock()
+	return true
+}
+
+// forwardAuthHandler asks an auth service whether to let each request
+// through.
+type forwardAuthHandler struct {
+	next    http.Handler
+	url     string
+	headers []string
+	client  *http.Client
+	logger  *slog.Logger
+}
+
+func newForwardAuthHandler(next http.Handler, gate models.AuthGate, logger *slog.Logger) *forwardAuthHandler {
+	return &forwardAuthHandler{
+		next:    next,
+		url:     gate.ForwardURL,
+		headers: gate.ForwardHeaders,
+		client: &http.Client{
+			Timeout: forwardAuthTimeout,
+			// a redirect to a login page is meant for the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger,
+	}
+}
+
+func (h *forwardAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := h.authRequest(r)
+	if err != nil {
+		h.logger.Error("forward auth failed", "url", h.url, "error", err.Error())
+		renderProxyError(w, r, http.StatusBadGateway)
+		return
+	}
+
+	resp, err := h.client.Do(req)
+	if canceled(r, err) {
+		return
+	}
+	if err != nil {
+		h.logger.Error("forward auth failed", "url", h.url, "error", err.Error())
+		renderProxyError(w, r, upstreamErrorStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the auth service decides what the client sees, e.g. a redirect to
+		// its login page. Hop-by-hop headers, and those its Connection
+		// header names, were only meant for us.
+		hop := slices.Clone(hopHeaders)
+		for _, v := range resp.Header.Values("Connection") {
+			for _, name := range strings.Split(v, ",") {
+				hop = append(hop, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+			}
+		}
+		for k, v := range resp.Header {
+			if !slices.Contains(hop, k) {
+				w.Header()[k] = v
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	// the client must not be able to pass these off as coming from the auth
+	// service
+	for _, name := range h.headers {
+		r.Header.Del(name)
+		if values := resp.Header.Values(name); len(values) > 0 {
+			r.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// authRequest builds the request to the auth service, carrying the client's
+// headers and describing the original request in X-Forwarded-* headers.
+func (h *forwardAuthHandler) authRequest(r *http.Request) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.Header {
+		switch k {
+		case "Connection", "Upgrade", "Content-Length", "Transfer-Encoding", "Te", "Trailer", "Keep-Alive":
+			continue
+		}
+		req.Header[k] = v
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	req.Header.Set("X-Forwarded-For", clientIP(r))
+	return req, nil
+}
+
+// hashPassword returns password as a bcrypt hash, passing through values that
+// already are one, like the lines of an htpasswd file.
+func hashPassword(password string) (string, error) {
+	if _, err := bcrypt.Cost([]byte(password)); err == nil {
+		return password, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func validateAuthGate(gate models.AuthGate, hosts []string) error {
+	for _, host := range gate.Hosts {
+		if !hasPattern(hosts, host) {
+			return fmt.Errorf("%s is not one of the service's hosts", host)
+		}
+	}
+
+	switch gate.Mode {
+	case models.AUTH_NONE:
+	case models.AUTH_BASIC:
+		if len(gate.Users) == 0 {
+			return errors.New("basic auth needs at least one user")
+		}
+	case models.AUTH_FORWARD:
+		u, err := url.Parse(gate.ForwardURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return errors.New("forward auth URL must be an http or https URL")
+		}
+		for _, name := range gate.ForwardHeaders {
+			if !validHeaderName(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown auth mode %q", gate.Mode)
+	}
+	return nil
+}
+
+// canceled reports whether err is only the client going away.
+func canceled(r *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) && r.Context().Err() != nil
+}
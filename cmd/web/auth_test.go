@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := models.AuthGate{Mode: models.AUTH_BASIC, Realm: "Staff", Users: []models.BasicAuthUser{{Username: "alice", PasswordHash: hash}}}
+	h := withAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "example.com", gate, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		code     int
+	}{
+		{name: "no credentials", code: http.StatusUnauthorized},
+		{name: "wrong password", username: "alice", password: "guess", code: http.StatusUnauthorized},
+		{name: "unknown user", username: "bob", password: "secret", code: http.StatusUnauthorized},
+		{name: "valid", username: "alice", password: "secret", code: http.StatusOK},
+		{name: "valid again", username: "alice", password: "secret", code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("status = %d; want %d", w.Code, tt.code)
+			}
+			if tt.code != http.StatusUnauthorized {
+				return
+			}
+			if got, want := w.Header().Get("WWW-Authenticate"), `Basic realm="Staff", charset="UTF-8"`; got != want {
+				t.Errorf("WWW-Authenticate = %q; want %q", got, want)
+			}
+			if !strings.Contains(w.Body.String(), errorPageMessages[http.StatusUnauthorized]) {
+				t.Errorf("body is not the error page: %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestForwardAuthResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		code     int
+		want     http.Header // headers the client must see
+		excluded []string    // headers the client must not see
+	}{
+		{
+			name:   "redirect to login",
+			status: http.StatusFound,
+			header: http.Header{
+				"Location":           {"https://login.example.com/"},
+				"Set-Cookie":         {"state=1"},
+				"Connection":         {"X-Auth-Internal"},
+				"X-Auth-Internal":    {"debug"},
+				"Keep-Alive":         {"timeout=5"},
+				"Proxy-Authenticate": {"Basic"},
+				"Upgrade":            {"h2c"},
+			},
+			code:     http.StatusFound,
+			want:     http.Header{"Location": {"https://login.example.com/"}, "Set-Cookie": {"state=1"}},
+			excluded: []string{"Connection", "X-Auth-Internal", "Keep-Alive", "Proxy-Authenticate", "Upgrade"},
+		},
+		{
+			name:     "forbidden",
+			status:   http.StatusForbidden,
+			header:   http.Header{"Content-Type": {"text/plain"}, "Trailer": {"X-Checksum"}},
+			code:     http.StatusForbidden,
+			want:     http.Header{"Content-Type": {"text/plain"}},
+			excluded: []string{"Trailer"},
+		},
+		{
+			name:   "allowed",
+			status: http.StatusOK,
+			header: http.Header{"X-User": {"alice"}},
+			code:   http.StatusNoContent,
+			want:   http.Header{"X-Seen-User": {"alice"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer authService.Close()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Seen-User", r.Header.Get("X-User"))
+				w.WriteHeader(http.StatusNoContent)
+			})
+			gate := models.AuthGate{Mode: models.AUTH_FORWARD, ForwardURL: authService.URL, ForwardHeaders: []string{"X-User"}}
+			h := withAuth(next, "example.com", gate, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.code {
+				t.Errorf("status = %d; want %d", w.Code, tt.code)
+			}
+			for k, v := range tt.want {
+				if got := w.Header().Get(k); got != v[0] {
+					t.Errorf("%s = %q; want %q", k, got, v[0])
+				}
+			}
+			for _, k := range tt.excluded {
+				if got := w.Header().Get(k); got != "" {
+					t.Errorf("%s = %q; want it dropped", k, got)
+				}
+			}
+		})
+	}
+}
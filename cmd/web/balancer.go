@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// upstream is a single replica of a service.
+type upstream struct {
+	url     *url.URL
+	rev     *httputil.ReverseProxy
+	breaker *breaker     // nil when circuit breaking is disabled
+	active  atomic.Int64 // requests currently in flight
+	healthy atomic.Bool
+}
+
+func newUpstream(remote *url.URL, service models.Service, transport http.RoundTripper, logger *slog.Logger) *upstream {
+	u := &upstream{
+		url:     remote,
+		rev:     httputil.NewSingleHostReverseProxy(remote),
+		breaker: newBreaker(service.CircuitBreaker),
+	}
+	u.healthy.Store(true)
+
+	u.rev.Transport = transport
+	if service.Kind == models.KIND_EXTERNAL && !service.External.PreserveHost {
+		director := u.rev.Director
+		u.rev.Director = func(r *http.Request) {
+			director(r)
+			r.Host = remote.Host
+		}
+	}
+
+	if u.breaker != nil || service.Retry.Enabled() {
+		u.rev.ModifyResponse = func(resp *http.Response) error {
+			if resp.StatusCode >= 500 {
+				u.breaker.failure()
+			} else {
+				u.breaker.success()
+			}
+			if retryStatus(resp.StatusCode) && retryAttemptFromContext(resp.Request).retriesOn(models.RETRY_STATUS) {
+				return errRetryStatus
+			}
+			return nil
+		}
+	}
+
+	u.rev.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		var tooLarge *http.MaxBytesError
+		if errors.Is(r.Context().Err(), context.Canceled) || errors.As(err, &tooLarge) {
+			// the client went away or sent too much, that says nothing
+			// about the upstream, unlike running out of the service's
+			// total timeout
+			u.breaker.release()
+		} else if !errors.Is(err, errRetryStatus) {
+			u.breaker.failure()
+		}
+		if retryAttemptFromContext(r).retry(r, err) {
+			return
+		}
+		logger.Error("upstream request failed", "upstream", remote.Host, "error", err.Error())
+		renderProxyError(w, r, upstreamErrorStatus(err))
+	}
+	return u
+}
+
+// balancer spreads requests for a service across its healthy replicas.
+type balancer struct {
+	strategy  models.LBStrategy
+	upstreams []*upstream
+	next      atomic.Uint64
+	transport http.RoundTripper // also used by the health checks
+	retry     *retryPolicy      // nil when requests are not retried
+	logger    *slog.Logger
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newBalancer(service models.Service, logger *slog.Logger) (*balancer, error) {
+	transport, err := newTransport(service)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &balancer{
+		strategy:  service.LBStrategy,
+		transport: transport,
+		retry:     newRetryPolicy(service.Retry),
+		logger:    logger,
+		stop:      make(chan struct{}),
+	}
+	for _, raw := range service.UpstreamUrls() {
+		remote, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		b.upstreams = append(b.upstreams, newUpstream(remote, service, transport, logger))
+	}
+	return b, nil
+}
+
+// close stops any background work of the balancer once it is no longer routed
+// to, and lets go of the idle connections of its own transport. It is safe to
+// call more than once.
+func (b *balancer) close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		// nil means the shared default transport, which isn't ours to close
+		if t, ok := b.transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	})
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.retry.applies(r) {
+		b.serveWithRetries(w, r)
+		return
+	}
+	b.serve(w, r, b.pick(r, nil))
+}
+
+// serve proxies r to u, or tells the client the service is unavailable when
+// there is no upstream to send it to.
+func (b *balancer) serve(w http.ResponseWriter, r *http.Request, u *upstream) {
+	if u == nil {
+		retryAfter := max(b.retryAfter(), time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+		renderProxyError(w, r, http.StatusServiceUnavailable)
+		return
+	}
+
+	u.active.Add(1)
+	defer u.active.Add(-1)
+
+	u.rev.ServeHTTP(w, r)
+}
+
+// retryAfter is how long until an upstream whose circuit is open takes
+// requests again, or a default for upstreams ejected by health checks.
+func (b *balancer) retryAfter() time.Duration {
+	var wait time.Duration
+	for _, u := range b.upstreams {
+		if !u.healthy.Load() {
+			continue
+		}
+		if d := u.breaker.retryAfter(); wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return 5 * time.Second
+	}
+	return wait
+}
+
+// pick returns the upstream that should serve r, or nil if none is healthy.
+// Upstreams in tried are only picked when there are no others left. The
+// picked upstream's circuit breaker has already been acquired.
+func (b *balancer) pick(r *http.Request, tried []*upstream) *upstream {
+	// a half-open breaker can be claimed by another request between checking
+	// and acquiring it, in which case we pick again
+	for range b.upstreams {
+		upstreams := b.available()
+		if len(tried) > 0 {
+			untried := slices.DeleteFunc(slices.Clone(upstreams), func(u *upstream) bool {
+				return slices.Contains(tried, u)
+			})
+			if len(untried) > 0 {
+				upstreams = untried
+			}
+		}
+
+		u := b.choose(r, upstreams)
+		if u == nil || u.breaker.acquire() {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *balancer) choose(r *http.Request, upstreams []*upstream) *upstream {
+	switch len(upstreams) {
+	case 0:
+		return nil
+	case 1:
+		return upstreams[0]
+	}
+
+	switch b.strategy {
+	case models.LEAST_CONNECTIONS:
+		// start at a rotating offset so ties don't all land on the first replica
+		offset := int(b.next.Add(1))
+		best := upstreams[offset%len(upstreams)]
+		for i := 1; i < len(upstreams); i++ {
+			u := upstreams[(offset+i)%len(upstreams)]
+			if u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		return best
+	case models.RANDOM:
+		return upstreams[rand.Intn(len(upstreams))]
+	case models.IP_HASH:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(r)))
+		return upstreams[h.Sum32()%uint32(len(upstreams))]
+	default:
+		n := b.next.Add(1) - 1
+		return upstreams[n%uint64(len(upstreams))]
+	}
+}
+
+// available returns the upstreams that are healthy and whose circuit is not
+// open.
+func (b *balancer) available() []*upstream {
+	ok := 0
+	for _, u := range b.upstreams {
+		if u.available() {
+			ok++
+		}
+	}
+	if ok == len(b.upstreams) {
+		return b.upstreams
+	}
+
+	upstreams := make([]*upstream, 0, ok)
+	for _, u := range b.upstreams {
+		if u.available() {
+			upstreams = append(upstreams, u)
+		}
+	}
+	return upstreams
+}
+
+func (u *upstream) available() bool {
+	return u.healthy.Load() && u.breaker.ready()
+}
+
+// clientIP returns the address of the client that sent the request, looking
+// past trusted proxies once setForwardedHeaders has run.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the peer that sent the request.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
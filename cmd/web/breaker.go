@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const defaultBreakerOpenDuration = 30 * time.Second
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker for a single upstream. It opens after too many
+// consecutive connection failures or 5xx responses and stays open for a while,
+// after which a single request is let through to decide whether it closes
+// again. A probe that hasn't finished within another open duration counts as
+// failed, so a hanging upstream can't keep the breaker half-open.
+type breaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+}
+
+func newBreaker(cfg models.CircuitBreaker) *breaker {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	openDuration := cfg.OpenDuration
+	if openDuration <= 0 {
+		openDuration = defaultBreakerOpenDuration
+	}
+	return &breaker{threshold: cfg.FailureThreshold, openDuration: openDuration}
+}
+
+// ready reports whether the breaker would let a request through right now.
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireProbe()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.openDuration
+	case breakerHalfOpen:
+		// the probe request is still in flight
+		return false
+	}
+	return true
+}
+
+// acquire claims the breaker for a request. Once the open duration has passed
+// only the first caller gets through, as the half-open probe.
+func (b *breaker) acquire() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireProbe()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probedAt = time.Now()
+		return true
+	case breakerHalfOpen:
+		return false
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// release gives up a half-open probe that ended without telling us anything
+// about the upstream, e.g. because the client went away.
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = time.Now().Add(-b.openDuration)
+	}
+}
+
+// retryAfter is how long until the breaker lets requests through again.
+func (b *breaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireProbe()
+	if b.state != breakerOpen {
+		return 0
+	}
+	return max(b.openDuration-time.Since(b.openedAt), 0)
+}
+
+// expireProbe reopens the breaker if its half-open probe is taking too long.
+// b.mu must be held.
+func (b *breaker) expireProbe() {
+	if b.state == breakerHalfOpen && time.Since(b.probedAt) >= b.openDuration {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		op    string // acquire, success, failure, release or wait
+		ok    bool   // what acquire returns
+		state breakerState
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens at the threshold",
+			steps: []step{
+				{op: "failure", state: breakerClosed},
+				{op: "acquire", ok: true, state: breakerClosed},
+				{op: "failure", state: breakerOpen},
+				{op: "acquire", ok: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "a success resets the failures",
+			steps: []step{
+				{op: "failure", state: breakerClosed},
+				{op: "success", state: breakerClosed},
+				{op: "failure", state: breakerClosed},
+			},
+		},
+		{
+			name: "closes after a successful probe",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure", state: breakerOpen},
+				{op: "wait", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+				{op: "acquire", ok: false, state: breakerHalfOpen},
+				{op: "success", state: breakerClosed},
+				{op: "acquire", ok: true, state: breakerClosed},
+			},
+		},
+		{
+			name: "reopens after a failed probe",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure", state: breakerOpen},
+				{op: "wait", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+				{op: "failure", state: breakerOpen},
+				{op: "acquire", ok: false, state: breakerOpen},
+			},
+		},
+		{
+			name: "a released probe can be tried again",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure", state: breakerOpen},
+				{op: "wait", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+				{op: "release", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+			},
+		},
+		{
+			name: "reopens when the probe hangs",
+			steps: []step{
+				{op: "failure"},
+				{op: "failure", state: breakerOpen},
+				{op: "wait", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+				{op: "wait", state: breakerHalfOpen},
+				{op: "acquire", ok: false, state: breakerOpen},
+				{op: "wait", state: breakerOpen},
+				{op: "acquire", ok: true, state: breakerHalfOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(models.CircuitBreaker{FailureThreshold: 2, OpenDuration: time.Minute})
+
+			for i, s := range tt.steps {
+				switch s.op {
+				case "acquire":
+					if ok := b.acquire(); ok != s.ok {
+						t.Fatalf("step %d: acquire() = %t; want %t", i+1, ok, s.ok)
+					}
+				case "success":
+					b.success()
+				case "failure":
+					b.failure()
+				case "release":
+					b.release()
+				case "wait":
+					// as if the open duration had passed
+					b.openedAt = b.openedAt.Add(-b.openDuration)
+					b.probedAt = b.probedAt.Add(-b.openDuration)
+				}
+				if s.state != b.state {
+					t.Fatalf("step %d (%s): state = %d; want %d", i+1, s.op, b.state, s.state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultCacheMaxSize = 64 << 20
+
+	// heuristic freshness is a tenth of the time since the response last
+	// changed, up to a day
+	maxHeuristicFreshness = 24 * time.Hour
+
+	revalidateTimeout = 30 * time.Second
+)
+
+// cacheableStatuses may be cached without explicit freshness information
+// (RFC 9110 section 15.1). Responses with other statuses are never stored.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// hopHeaders only concern a single connection and are never stored.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// httpCache is a shared cache (RFC 9111) for the responses of a service.
+type httpCache struct {
+	cfg          models.Cache
+	store        *cacheStore
+	maxEntrySize int
+	logger       *slog.Logger
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+func newHTTPCache(cfg models.Cache, service string, logger *slog.Logger) (*httpCache, error) {
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultCacheMaxSize
+	}
+
+	dir := ""
+	if cfg.Dir != "" {
+		// a directory of its own, whatever else lives in the one configured
+		dir = filepath.Join(cfg.Dir, "delne-cache", cacheDirName(service))
+	}
+
+	store, err := newCacheStore(dir, maxSize, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpCache{
+		cfg:   cfg,
+		store: store,
+		// so a single response can't push everything else out
+		maxEntrySize: int(maxSize / 8),
+		logger:       logger,
+		revalidating: map[string]bool{},
+	}, nil
+}
+
+// cacheDirName turns a service name into a directory name that stays inside
+// the directory it is joined to.
+func cacheDirName(service string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, service)
+	if strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+	return name
+}
+
+// lookup finds the entry for a request, following the Vary header of the
+// response stored for its URL to the variant matching the request.
+func (c *httpCache) lookup(primary string, r *http.Request) *cacheEntry {
+	e, ok := c.store.get(primary)
+	if !ok {
+		return nil
+	}
+	if len(e.VaryHeaders) > 0 {
+		e, ok = c.store.get(variantKey(primary, e.VaryHeaders, r))
+		if !ok {
+			return nil
+		}
+	}
+	return e
+}
+
+// save stores a response for a request, under a variant key if it varies.
+func (c *httpCache) save(primary string, r *http.Request, e *cacheEntry) {
+	vary := varyHeaders(e.Header)
+	if len(vary) == 0 {
+		e.Key = primary
+		c.store.set(e)
+		return
+	}
+
+	c.store.set(&cacheEntry{Key: primary, VaryHeaders: vary, ResponseTime: e.ResponseTime})
+	e.Key = variantKey(primary, vary, r)
+	c.store.set(e)
+}
+
+// invalidate drops what is stored for a URL, variants included.
+func (c *httpCache) invalidate(primary string) {
+	c.store.deleteMatching(func(key string) bool {
+		return key == primary || strings.HasPrefix(key, primary+"\x00")
+	})
+}
+
+// purge drops the entries for paths under prefix on host, or on every host
+// when host is empty.
+func (c *httpCache) purge(host, prefix string) int {
+	return c.store.deleteMatching(func(key string) bool {
+		keyHost, uri, _ := strings.Cut(key, "/")
+		return (host == "" || keyHost == host) && strings.HasPrefix("/"+uri, prefix)
+	})
+}
+
+// storable reports whether a response to r may be stored.
+func (c *httpCache) storable(r *http.Request, status int, header http.Header) bool {
+	if r.Method != http.MethodGet || !cacheableStatuses[status] {
+		return false
+	}
+
+	cc := parseCacheControl(header.Values("Cache-Control"))
+	switch {
+	case cc.has("no-store"), cc.has("private"):
+		return false
+	case header.Get("Set-Cookie") != "":
+		// one client's cookie must never be handed to another
+		return false
+	case strings.Contains(header.Get("Vary"), "*"):
+		return false
+	case r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	}
+
+	explicit := cc.has("s-maxage") || cc.has("max-age") || header.Get("Expires") != ""
+	validators := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	return explicit || validators || cc.has("public")
+}
+
+// cacheHandler answers requests from its cache where it can and stores the
+// responses of next.
+type cacheHandler struct {
+	next  http.Handler
+	cache *httpCache
+}
+
+// withCache wraps next if the service has a cache.
+func withCache(next http.Handler, cache *httpCache) http.Handler {
+	if cache == nil {
+		return next
+	}
+	return &cacheHandler{next: next, cache: cache}
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.cache
+	primary := cacheKey(r)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.next.ServeHTTP(w, r)
+		// a request that may have changed the resource invalidates it
+		if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+			c.invalidate(primary)
+		}
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if !strings.HasPrefix(r.RequestURI, "/") || reqCC.has("no-store") || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	noCache := reqCC.has("no-cache") || (len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache")
+	entry := c.lookup(primary, r)
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			renderProxyError(w, r, http.StatusGatewayTimeout)
+			return
+		}
+		h.forward(w, r, primary, nil)
+		return
+	}
+
+	now := time.Now()
+	age, lifetime := entry.age(now), entry.lifetime()
+	resCC := parseCacheControl(entry.Header.Values("Cache-Control"))
+
+	usable := !noCache && !resCC.has("no-cache")
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		usable = false
+	}
+
+	if usable && age < lifetime {
+		serveEntry(w, r, entry, age, "hit")
+		return
+	}
+
+	if usable && !resCC.has("must-revalidate") && !resCC.has("proxy-revalidate") {
+		if swr, ok := resCC.seconds("stale-while-revalidate"); ok && age < lifetime+swr {
+			h.revalidate(r, primary, entry)
+			serveEntry(w, r, entry, age, "hit; detail=stale-while-revalidate")
+			return
+		}
+	}
+
+	h.forward(w, r, primary, entry)
+}
+
+// forward passes the request on to next, as a conditional request when there
+// is a stale entry to validate, and stores what comes back.
+func (h *cacheHandler) forward(w http.ResponseWriter, r *http.Request, primary string, stale *cacheEntry) {
+	out := r
+	if stale != nil {
+		etag, lastModified := stale.Header.Get("ETag"), stale.Header.Get("Last-Modified")
+		if etag == "" && lastModified == "" {
+			stale = nil
+		} else {
+			// the client's own conditions are checked against the entry
+			// once it is validated
+			out = r.Clone(r.Context())
+			out.Header.Del("If-None-Match")
+			out.Header.Del("If-Modified-Since")
+			if etag != "" {
+				out.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				out.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	outer := map[string]bool{}
+	for k := range w.Header() {
+		outer[k] = true
+	}
+
+	cw := &cacheWriter{
+		ResponseWriter: w,
+		cache:          h.cache,
+		r:              r,
+		stale:          stale,
+		outer:          outer,
+		requestTime:    time.Now(),
+	}
+	h.next.ServeHTTP(cw, out)
+	cw.finish(primary)
+}
+
+// revalidate refreshes a stale entry in the background, at most once at a
+// time.
+func (h *cacheHandler) revalidate(r *http.Request, primary string, stale *cacheEntry) {
+	c := h.cache
+	c.mu.Lock()
+	if c.revalidating[stale.Key] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[stale.Key] = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), revalidateTimeout)
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.revalidating, stale.Key)
+			c.mu.Unlock()
+		}()
+		h.forward(&discardWriter{header: http.Header{}}, req, primary, stale)
+	}()
+}
+
+// cacheWriter passes a response on to the client while keeping a copy to
+// store. A 304 confirming a stale entry is held back and the entry served
+// instead.
+type cacheWriter struct {
+	http.ResponseWriter
+	cache       *httpCache
+	r           *http.Request
+	stale       *cacheEntry
+	outer       map[string]bool // headers set before the response, not part of it
+	requestTime time.Time
+
+	status      int
+	header      http.Header // the response's own headers, as next set them
+	notModified bool
+	store       bool
+	body        []byte
+}
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	cw.status = code
+	// the writers around this one share the header map and change it once
+	// the headers are sent, e.g. compression or response header rules, which
+	// must not end up in the stored entry
+	cw.header = http.Header{}
+	for k, v := range cw.Header() {
+		if !cw.outer[k] {
+			cw.header[k] = slices.Clone(v)
+		}
+	}
+
+	if cw.stale != nil && code == http.StatusNotModified {
+		cw.notModified = true
+		return
+	}
+
+	cw.store = cw.cache.storable(cw.r, code, cw.Header())
+	if cw.stale != nil {
+		cw.Header().Set("Cache-Status", "delne; fwd=stale; fwd-status="+strconv.Itoa(code))
+	} else {
+		cw.Header().Set("Cache-Status", "delne; fwd=miss")
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(p), nil
+	}
+
+	if cw.store {
+		if len(cw.body)+len(p) > cw.cache.maxEntrySize {
+			cw.store, cw.body = false, nil
+		} else {
+			cw.body = append(cw.body, p...)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.notModified {
+		return
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish stores the response once next is done with it.
+func (cw *cacheWriter) finish(primary string) {
+	now := time.Now()
+
+	if cw.notModified {
+		// the 304 carries updated headers for the stored response
+		header := cw.stale.Header.Clone()
+		for k, v := range cw.header {
+			if k != "Content-Length" {
+				header[k] = v
+			}
+		}
+		entry := &cacheEntry{
+			Key:          cw.stale.Key,
+			Status:       cw.stale.Status,
+			Header:       header,
+			Body:         cw.stale.Body,
+			RequestTime:  cw.requestTime,
+			ResponseTime: now,
+		}
+		cw.cache.store.set(entry)
+		serveEntry(cw.ResponseWriter, cw.r, entry, entry.age(now), "fwd=stale; fwd-status=304")
+		return
+	}
+
+	if cw.status == 0 || !cw.store {
+		// a failing upstream leaves the stale entry for later, anything
+		// else replaced it
+		if cw.stale != nil && cw.r.Method == http.MethodGet && cw.status != 0 && cw.status < 500 {
+			cw.cache.store.delete(cw.stale.Key)
+		}
+		return
+	}
+
+	header := http.Header{}
+	for k, v := range cw.header {
+		if k != "Cache-Status" && k != "Set-Cookie" && !slices.Contains(hopHeaders, k) {
+			header[k] = v
+		}
+	}
+	cw.cache.save(primary, cw.r, &cacheEntry{
+		Status:       cw.status,
+		Header:       header,
+		Body:         cw.body,
+		RequestTime:  cw.requestTime,
+		ResponseTime: now,
+	})
+}
+
+// serveEntry answers a request from a stored response, with a 304 if the
+// client's copy is still current.
+func serveEntry(w http.ResponseWriter, r *http.Request, e *cacheEntry, age time.Duration, status string) {
+	header := w.Header()
+	for k, v := range e.Header {
+		header[k] = slices.Clone(v)
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	header.Set("Cache-Status", "delne; "+status)
+
+	if notModified(r, e) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if e.Status != http.StatusNoContent {
+		header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// notModified evaluates the client's conditional headers against an entry.
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// date is when the response was generated according to the upstream.
+func (e *cacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// age is the current age of the entry (RFC 9111 section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	ageValue := time.Duration(0)
+	if n, err := strconv.Atoi(e.Header.Get("Age")); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+
+	apparent := max(0, e.ResponseTime.Sub(e.date()))
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// lifetime is how long the entry is fresh for (RFC 9111 section 4.2.1).
+func (e *cacheEntry) lifetime() time.Duration {
+	cc := parseCacheControl(e.Header.Values("Cache-Control"))
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// an invalid date means already expired
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if modified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		return min(e.date().Sub(modified)/10, maxHeuristicFreshness)
+	}
+	return 0
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := cacheControl{}
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheKey identifies the URL a request is for, as the client sees it.
+func cacheKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host) + r.RequestURI
+}
+
+// variantKey extends the key of a URL with the request's values for the
+// headers the response varies by.
+func variantKey(primary string, vary []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// discardWriter is the client of background revalidations.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// serviceCache returns the cache of a service, keeping the one it already
+// has while its settings stay the same so entries survive redeploys.
+func (p *Proxy) serviceCache(service models.Service) (*httpCache, error) {
+	p.cachesMu.Lock()
+	defer p.cachesMu.Unlock()
+
+	if !service.Cache.Enabled {
+		delete(p.caches, service.Name)
+		return nil, nil
+	}
+	if c, ok := p.caches[service.Name]; ok && c.cfg == service.Cache {
+		return c, nil
+	}
+
+	c, err := newHTTPCache(service.Cache, service.Name, p.logger.With("cache", service.Name))
+	if err != nil {
+		return nil, err
+	}
+	p.caches[service.Name] = c
+	return c, nil
+}
+
+// PurgeCache drops the cached responses for paths under prefix on host, or on
+// every host when host is empty, and returns how many there were.
+func (p *Proxy) PurgeCache(host, prefix string) int {
+	p.cachesMu.Lock()
+	defer p.cachesMu.Unlock()
+
+	n := 0
+	for _, c := range p.caches {
+		n += c.purge(host, prefix)
+	}
+	return n
+}
+
+// cacheDirTaken reports whether another service already keeps its cache in
+// dir.
+func (app *application) cacheDirTaken(service *models.Service, dir string) (bool, error) {
+	if dir == "" {
+		return false, nil
+	}
+
+	services, err := app.services.GetAll()
+	if err != nil {
+		return false, err
+	}
+	for _, other := range services {
+		if other.ID != service.ID && other.Cache.Dir != "" && filepath.Clean(other.Cache.Dir) == filepath.Clean(dir) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (app *application) purgeCache(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	host := strings.ToLower(strings.TrimSpace(r.Form.Get("host")))
+	prefix := r.Form.Get("prefix")
+	if prefix == "" {
+		prefix = "/"
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	n := app.proxy.PurgeCache(host, prefix)
+	app.logger.Info("purged cache", "host", host, "prefix", prefix, "entries", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": n})
+}
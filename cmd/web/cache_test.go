@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+	"github.com/klauspost/compress/gzip"
+)
+
+func newTestCache(t *testing.T, cfg models.Cache) *httpCache {
+	t.Helper()
+	cfg.Enabled = true
+	c, err := newHTTPCache(cfg, "test", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serveTest sends a GET for path from the client at ip through h.
+func serveTest(h http.Handler, path, ip string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Host = "example.com"
+	r.RemoteAddr = ip + ":1234"
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCacheWithCompression(t *testing.T) {
+	body := strings.Repeat("cacheable text ", 400)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(w, body)
+	})
+	h := withCompression(withCache(upstream, newTestCache(t, models.Cache{})), models.Compression{Enabled: true})
+
+	tests := []struct {
+		name     string
+		encoding string
+		status   string
+	}{
+		{name: "miss compressed", encoding: "gzip", status: "delne; fwd=miss"},
+		{name: "hit compressed", encoding: "gzip", status: "delne; hit"},
+		{name: "hit plain", encoding: "", status: "delne; hit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.encoding != "" {
+				header.Set("Accept-Encoding", tt.encoding)
+			}
+			w := serveTest(h, "/page", "10.0.0.1", header)
+
+			if got := w.Header().Get("Cache-Status"); got != tt.status {
+				t.Errorf("Cache-Status = %q; want %q", got, tt.status)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q; want %q", got, tt.encoding)
+			}
+
+			got := w.Body.Bytes()
+			if tt.encoding == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(got))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(got) != body {
+				t.Errorf("body has %d bytes; want the original %d", len(got), len(body))
+			}
+		})
+	}
+}
+
+func TestCacheWithHeaderRules(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		io.WriteString(w, "hello")
+	})
+	rules := []models.HeaderRule{
+		{Target: models.HEADER_RESPONSE, Action: models.HEADER_APPEND, Name: "X-Seen-By", Value: "{client_ip}"},
+	}
+	h := withHeaderRules(withCache(upstream, newTestCache(t, models.Cache{})), rules)
+
+	tests := []struct {
+		name   string
+		ip     string
+		status string
+	}{
+		{name: "miss", ip: "10.0.0.1", status: "delne; fwd=miss"},
+		{name: "hit for another client", ip: "10.0.0.2", status: "delne; hit"},
+		{name: "hit again", ip: "10.0.0.3", status: "delne; hit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(h, "/", tt.ip, nil)
+			if got := w.Header().Get("Cache-Status"); got != tt.status {
+				t.Errorf("Cache-Status = %q; want %q", got, tt.status)
+			}
+			if got := w.Header().Values("X-Seen-By"); !slices.Equal(got, []string{tt.ip}) {
+				t.Errorf("X-Seen-By = %q; want only %q", got, tt.ip)
+			}
+		})
+	}
+}
+
+func TestCacheDirLeavesOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{"important.conf", "0123.tmp.bak", strings.Repeat("a", 63)}
+	for _, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("keep"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestCache(t, models.Cache{Dir: dir, MaxSize: 1 << 20})
+	c.store.set(&cacheEntry{Key: "example.com/", Status: http.StatusOK, Body: []byte("hello")})
+	c.purge("", "/")
+
+	for _, name := range files {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "delne-cache", "test")); err != nil {
+		t.Errorf("cache directory: %v", err)
+	}
+}
+
+func TestCacheDirName(t *testing.T) {
+	tests := []struct {
+		service string
+		want    string
+	}{
+		{service: "web", want: "web"},
+		{service: "my-app_2.0", want: "my-app_2.0"},
+		{service: "../../etc", want: ".._.._etc"},
+		{service: "..", want: "_.."},
+		{service: "", want: "_"},
+		{service: "a/b c", want: "a_b_c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			if got := cacheDirName(tt.service); got != tt.want {
+				t.Errorf("cacheDirName(%q) = %q; want %q", tt.service, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryAge(t *testing.T) {
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := received.Add(10 * time.Second)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		sent   time.Duration // before the response was received
+		want   time.Duration
+	}{
+		{name: "fresh from upstream", want: 10 * time.Second},
+		{name: "age header", header: http.Header{"Age": {"30"}}, want: 40 * time.Second},
+		{name: "invalid age header", header: http.Header{"Age": {"soon"}}, want: 10 * time.Second},
+		{name: "date in the past", header: http.Header{"Date": {received.Add(-5 * time.Second).Format(http.TimeFormat)}}, want: 15 * time.Second},
+		{name: "date in the future", header: http.Header{"Date": {received.Add(time.Hour).Format(http.TimeFormat)}}, want: 10 * time.Second},
+		{name: "slow upstream", sent: 2 * time.Second, want: 12 * time.Second},
+		{name: "age and slow upstream", header: http.Header{"Age": {"30"}}, sent: 2 * time.Second, want: 42 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &cacheEntry{Header: tt.header, RequestTime: received.Add(-tt.sent), ResponseTime: received}
+			if e.Header == nil {
+				e.Header = http.Header{}
+			}
+			if got := e.age(now); got != tt.want {
+				t.Errorf("age() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheEntryLifetime(t *testing.T) {
+	date := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) string { return date.Add(d).Format(http.TimeFormat) }
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{name: "nothing", header: http.Header{}, want: 0},
+		{name: "max-age", header: http.Header{"Cache-Control": {"max-age=60"}}, want: time.Minute},
+		{name: "s-maxage over max-age", header: http.Header{"Cache-Control": {"max-age=60, s-maxage=10"}}, want: 10 * time.Second},
+		{name: "max-age over expires", header: http.Header{"Cache-Control": {"max-age=60"}, "Expires": {at(time.Hour)}}, want: time.Minute},
+		{name: "invalid max-age", header: http.Header{"Cache-Control": {"max-age=-1"}}, want: 0},
+		{name: "expires", header: http.Header{"Expires": {at(2 * time.Minute)}}, want: 2 * time.Minute},
+		{name: "invalid expires", header: http.Header{"Expires": {"0"}, "Last-Modified": {at(-10 * time.Hour)}}, want: 0},
+		{name: "heuristic", header: http.Header{"Last-Modified": {at(-10 * time.Hour)}}, want: time.Hour},
+		{name: "heuristic up to a day", header: http.Header{"Last-Modified": {at(-30 * 24 * time.Hour)}}, want: maxHeuristicFreshness},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.header.Set("Date", date.Format(http.TimeFormat))
+			e := &cacheEntry{Header: tt.header, RequestTime: date, ResponseTime: date}
+			if got := e.lifetime(); got != tt.want {
+				t.Errorf("lifetime() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   cacheControl
+	}{
+		{name: "none", values: nil, want: cacheControl{}},
+		{name: "directives", values: []string{"public, max-age=60"}, want: cacheControl{"public": "", "max-age": "60"}},
+		{name: "several headers", values: []string{"no-cache", "Max-Age=10"}, want: cacheControl{"no-cache": "", "max-age": "10"}},
+		{name: "quoted value", values: []string{`private="Set-Cookie"`}, want: cacheControl{"private": "Set-Cookie"}},
+		{name: "empty parts", values: []string{" , ,no-store ,"}, want: cacheControl{"no-store": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCacheControl(tt.values); !maps.Equal(got, tt.want) {
+				t.Errorf("parseCacheControl(%q) = %v; want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheControlSeconds(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "max-age=60", want: time.Minute, wantOK: true},
+		{value: "max-age=0", want: 0, wantOK: true},
+		{value: "max-age=-1", wantOK: false},
+		{value: "max-age=soon", wantOK: false},
+		{value: "no-cache", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseCacheControl([]string{tt.value}).seconds("max-age")
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("seconds() = %v, %t; want %v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCacheStorable(t *testing.T) {
+	c := newTestCache(t, models.Cache{})
+
+	tests := []struct {
+		name      string
+		method    string
+		status    int
+		header    http.Header
+		reqHeader http.Header
+		want      bool
+	}{
+		{name: "max-age", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, want: true},
+		{name: "expires", status: http.StatusOK, header: http.Header{"Expires": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, want: true},
+		{name: "validator", status: http.StatusOK, header: http.Header{"Etag": {`"v1"`}}, want: true},
+		{name: "public", status: http.StatusNotFound, header: http.Header{"Cache-Control": {"public"}}, want: true},
+		{name: "no freshness", status: http.StatusOK, header: http.Header{}, want: false},
+		{name: "head request", method: http.MethodHead, status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}}, want: false},
+		{name: "uncacheable status", status: http.StatusInternalServerError, header: http.Header{"Cache-Control": {"max-age=60"}}, want: false},
+		{name: "no-store", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60, no-store"}}, want: false},
+		{name: "private", status: http.StatusOK, header: http.Header{"Cache-Control": {"private, max-age=60"}}, want: false},
+		{name: "set-cookie", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}}, want: false},
+		{name: "vary star", status: http.StatusOK, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, want: false},
+		{
+			name: "authorized", status: http.StatusOK,
+			header:    http.Header{"Cache-Control": {"max-age=60"}},
+			reqHeader: http.Header{"Authorization": {"Bearer token"}},
+			want:      false,
+		},
+		{
+			name: "authorized public", status: http.StatusOK,
+			header:    http.Header{"Cache-Control": {"public, max-age=60"}},
+			reqHeader: http.Header{"Authorization": {"Bearer token"}},
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "/", nil)
+			for k, v := range tt.reqHeader {
+				r.Header[k] = v
+			}
+			if got := c.storable(r, tt.status, tt.header); got != tt.want {
+				t.Errorf("storable() = %t; want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "hello "+r.Header.Get("Accept-Language"))
+	})
+	h := withCache(upstream, newTestCache(t, models.Cache{}))
+
+	tests := []struct {
+		name     string
+		language string
+		status   string
+	}{
+		{name: "first variant", language: "en", status: "delne; fwd=miss"},
+		{name: "second variant", language: "fr", status: "delne; fwd=miss"},
+		{name: "first variant again", language: "en", status: "delne; hit"},
+		{name: "second variant again", language: "fr", status: "delne; hit"},
+		{name: "without the header", language: "", status: "delne; fwd=miss"},
+		{name: "without the header again", language: "", status: "delne; hit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.language != "" {
+				header.Set("Accept-Language", tt.language)
+			}
+			w := serveTest(h, "/", "10.0.0.1", header)
+			if got := w.Header().Get("Cache-Status"); got != tt.status {
+				t.Errorf("Cache-Status = %q; want %q", got, tt.status)
+			}
+			if got, want := w.Body.String(), "hello "+tt.language; got != want {
+				t.Errorf("body = %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var conditional atomic.Int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			// confirmed, and fresh for a while now
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		io.WriteString(w, "v1")
+	})
+	h := withCache(upstream, newTestCache(t, models.Cache{}))
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		code        int
+		status      string
+		body        string
+		conditional int32
+	}{
+		{name: "miss", code: http.StatusOK, status: "delne; fwd=miss", body: "v1"},
+		{name: "stale entry validated", code: http.StatusOK, status: "delne; fwd=stale; fwd-status=304", body: "v1", conditional: 1},
+		{name: "fresh after validation", code: http.StatusOK, status: "delne; hit", body: "v1", conditional: 1},
+		{name: "client copy current", ifNoneMatch: `"v1"`, code: http.StatusNotModified, status: "delne; hit", conditional: 1},
+		{name: "client copy outdated", ifNoneMatch: `"v0"`, code: http.StatusOK, status: "delne; hit", body: "v1", conditional: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.ifNoneMatch != "" {
+				header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := serveTest(h, "/", "10.0.0.1", header)
+			if w.Code != tt.code {
+				t.Errorf("status = %d; want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Cache-Status"); got != tt.status {
+				t.Errorf("Cache-Status = %q; want %q", got, tt.status)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body = %q; want %q", got, tt.body)
+			}
+			if got := conditional.Load(); got != tt.conditional {
+				t.Errorf("upstream got %d conditional requests; want %d", got, tt.conditional)
+			}
+		})
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		status       string
+		body         string
+		next         string // body of the request after the upstream's second response
+	}{
+		{
+			name:         "served stale",
+			cacheControl: "max-age=0, stale-while-revalidate=60",
+			status:       "delne; hit; detail=stale-while-revalidate",
+			body:         "1",
+			next:         "2",
+		},
+		{
+			name:         "must revalidate",
+			cacheControl: "max-age=0, stale-while-revalidate=60, must-revalidate",
+			status:       "delne; fwd=miss",
+			body:         "2",
+			next:         "3",
+		},
+		{
+			name:         "without stale-while-revalidate",
+			cacheControl: "max-age=0",
+			status:       "delne; fwd=miss",
+			body:         "2",
+			next:         "3",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				io.WriteString(w, strconv.Itoa(int(calls.Add(1))))
+			})
+			c := newTestCache(t, models.Cache{})
+			h := withCache(upstream, c)
+
+			serveTest(h, "/", "10.0.0.1", nil)
+			w := serveTest(h, "/", "10.0.0.1", nil)
+			if got := w.Header().Get("Cache-Status"); got != tt.status {
+				t.Errorf("Cache-Status = %q; want %q", got, tt.status)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body = %q; want %q", got, tt.body)
+			}
+
+			// the revalidation in the background is done once it stored
+			// the upstream's second response
+			waitRevalidated(t, c)
+			if got := calls.Load(); got != 2 {
+				t.Fatalf("upstream got %d requests; want 2", got)
+			}
+
+			w = serveTest(h, "/", "10.0.0.1", nil)
+			if got := w.Body.String(); got != tt.next {
+				t.Errorf("next body = %q; want %q", got, tt.next)
+			}
+			// which may have started another one
+			waitRevalidated(t, c)
+		})
+	}
+}
+
+// waitRevalidated waits for the cache's background revalidations to finish.
+func waitRevalidated(t *testing.T, c *httpCache) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		busy := len(c.revalidating) > 0
+		c.mu.Unlock()
+		if !busy {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("revalidation still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	keys := []string{
+		"example.com/a",
+		"example.com/a\x00Accept-Language=en",
+		"example.com/a/b",
+		"example.com/b?page=2",
+		"other.com/a",
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		prefix string
+		want   []string // the keys left
+	}{
+		{name: "everything", host: "", prefix: "/", want: []string{}},
+		{name: "prefix on every host", host: "", prefix: "/a", want: []string{"example.com/b?page=2"}},
+		{name: "prefix on one host", host: "example.com", prefix: "/a", want: []string{"example.com/b?page=2", "other.com/a"}},
+		{name: "single path", host: "example.com", prefix: "/a/b", want: []string{"example.com/a", "example.com/a\x00Accept-Language=en", "example.com/b?page=2", "other.com/a"}},
+		{name: "query", host: "example.com", prefix: "/b?page", want: []string{"example.com/a", "example.com/a\x00Accept-Language=en", "example.com/a/b", "other.com/a"}},
+		{name: "unknown host", host: "nope.com", prefix: "/", want: keys},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, models.Cache{})
+			for _, key := range keys {
+				c.store.set(&cacheEntry{Key: key, Status: http.StatusOK, Header: http.Header{}})
+			}
+
+			if got := c.purge(tt.host, tt.prefix); got != len(keys)-len(tt.want) {
+				t.Errorf("purge(%q, %q) = %d; want %d", tt.host, tt.prefix, got, len(keys)-len(tt.want))
+			}
+			left := []string{}
+			for key := range c.store.items {
+				left = append(left, key)
+			}
+			slices.Sort(left)
+			if !slices.Equal(left, tt.want) {
+				t.Errorf("left %q; want %q", left, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheStoreDisk(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	received := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		entry *cacheEntry
+	}{
+		{
+			name: "response",
+			entry: &cacheEntry{
+				Key:          "example.com/page",
+				Status:       http.StatusOK,
+				Header:       http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}},
+				Body:         []byte("hello"),
+				RequestTime:  received.Add(-time.Second),
+				ResponseTime: received,
+			},
+		},
+		{
+			name:  "empty body",
+			entry: &cacheEntry{Key: "example.com/empty", Status: http.StatusNoContent, Header: http.Header{}, ResponseTime: received},
+		},
+		{
+			name:  "vary",
+			entry: &cacheEntry{Key: "example.com/vary", VaryHeaders: []string{"Accept-Language"}, ResponseTime: received},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := newCacheStore(dir, 1<<20, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.set(tt.entry)
+
+			// a write that never finished and a file that isn't an entry
+			leftover := filepath.Join(dir, "123.tmp")
+			corrupt := filepath.Join(dir, strings.Repeat("0", 64))
+			for _, path := range []string{leftover, corrupt} {
+				if err := os.WriteFile(path, []byte("junk"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err = newCacheStore(dir, 1<<20, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := s.get(tt.entry.Key)
+			if !ok {
+				t.Fatalf("entry %q is gone after reopening the store", tt.entry.Key)
+			}
+
+			switch {
+			case got.Key != tt.entry.Key, got.Status != tt.entry.Status:
+				t.Errorf("got %q %d; want %q %d", got.Key, got.Status, tt.entry.Key, tt.entry.Status)
+			case !bytes.Equal(got.Body, tt.entry.Body):
+				t.Errorf("body = %q; want %q", got.Body, tt.entry.Body)
+			case len(got.Header) != len(tt.entry.Header) || got.Header.Get("Etag") != tt.entry.Header.Get("Etag"):
+				t.Errorf("header = %v; want %v", got.Header, tt.entry.Header)
+			case !slices.Equal(got.VaryHeaders, tt.entry.VaryHeaders):
+				t.Errorf("vary headers = %q; want %q", got.VaryHeaders, tt.entry.VaryHeaders)
+			case !got.RequestTime.Equal(tt.entry.RequestTime), !got.ResponseTime.Equal(tt.entry.ResponseTime):
+				t.Errorf("times = %v, %v; want %v, %v", got.RequestTime, got.ResponseTime, tt.entry.RequestTime, tt.entry.ResponseTime)
+			}
+
+			for _, path := range []string{leftover, corrupt} {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("%s was left behind", filepath.Base(path))
+				}
+			}
+		})
+	}
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	dir := t.TempDir()
+	entry := func(key string) *cacheEntry {
+		return &cacheEntry{Key: key, Status: http.StatusOK, Header: http.Header{}, Body: bytes.Repeat([]byte("x"), 100)}
+	}
+	// room for two entries
+	s, err := newCacheStore(dir, 2*entry("/a").size()+10, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.set(entry("/a"))
+	s.set(entry("/b"))
+	s.get("/a") // /b is now the least recently used
+	s.set(entry("/c"))
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "/a", want: true},
+		{key: "/b", want: false},
+		{key: "/c", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if _, ok := s.get(tt.key); ok != tt.want {
+				t.Errorf("get(%q) found %t; want %t", tt.key, ok, tt.want)
+			}
+			if _, err := os.Stat(s.path(tt.key)); (err == nil) != tt.want {
+				t.Errorf("file of %q exists %t; want %t", tt.key, err == nil, tt.want)
+			}
+		})
+	}
+}
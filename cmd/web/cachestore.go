@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a stored response. Entries are shared between requests and
+// must not be modified once stored.
+type cacheEntry struct {
+	Key    string
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// RequestTime and ResponseTime are when the request that produced the
+	// entry was sent and its response received, for working out its age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// VaryHeaders is set on the entry stored under the plain request key of
+	// a response with a Vary header, pointing at the variants.
+	VaryHeaders []string
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for k, v := range e.Header {
+		size += int64(len(k))
+		for _, s := range v {
+			size += int64(len(s))
+		}
+	}
+	return size
+}
+
+// cacheStore keeps entries up to a total size, evicting the least recently
+// used. Entries live in memory, or in files under dir when it is set.
+type cacheStore struct {
+	dir     string
+	maxSize int64
+	logger  *slog.Logger
+
+	mu    sync.Mutex
+	lru   *list.List // of *storeItem, most recently used first
+	items map[string]*list.Element
+	size  int64
+}
+
+type storeItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry // nil for entries on disk
+}
+
+// entryFileName matches the files a disk store writes, named by the hash of
+// an entry's key or temporary while they are written. Nothing else in its
+// directory is touched.
+var entryFileName = regexp.MustCompile(`^([0-9a-f]{64}|[0-9]+\.tmp)$`)
+
+// newCacheStore opens a store, picking up the entries a disk store left
+// behind.
+func newCacheStore(dir string, maxSize int64, logger *slog.Logger) (*cacheStore, error) {
+	s := &cacheStore{
+		dir:     dir,
+		maxSize: maxSize,
+		logger:  logger,
+		lru:     list.New(),
+		items:   map[string]*list.Element{},
+	}
+	if dir == "" {
+		return s, nil
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if !f.Type().IsRegular() || !entryFileName.MatchString(f.Name()) {
+			continue
+		}
+		if filepath.Ext(f.Name()) == ".tmp" {
+			// left over from a write that never finished
+			os.Remove(path)
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		entry, err := s.read(path, false)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+		s.add(entry.Key, info.Size(), nil)
+	}
+	s.evict()
+	return s, nil
+}
+
+func (s *cacheStore) get(key string) (*cacheEntry, bool) {
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	item := el.Value.(*storeItem)
+	s.mu.Unlock()
+
+	if item.entry != nil {
+		return item.entry, true
+	}
+
+	entry, err := s.read(s.path(key), true)
+	if err != nil {
+		s.logger.Error("reading cached response failed", "key", key, "error", err.Error())
+		s.delete(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *cacheStore) set(entry *cacheEntry) {
+	size := entry.size()
+	if size > s.maxSize {
+		return
+	}
+
+	key := entry.Key
+	if s.dir != "" {
+		err := s.write(entry)
+		if err != nil {
+			s.logger.Error("caching response failed", "key", key, "error", err.Error())
+			return
+		}
+		// only the file keeps the entry
+		entry = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(key, size, entry)
+	s.evict()
+}
+
+// add tracks an entry, replacing any with the same key. Callers hold s.mu.
+func (s *cacheStore) add(key string, size int64, entry *cacheEntry) {
+	if el, ok := s.items[key]; ok {
+		s.size -= el.Value.(*storeItem).size
+		s.lru.Remove(el)
+	}
+	s.items[key] = s.lru.PushFront(&storeItem{key: key, size: size, entry: entry})
+	s.size += size
+}
+
+// evict drops the least recently used entries until the store fits its size.
+// Callers hold s.mu.
+func (s *cacheStore) evict() {
+	for s.size > s.maxSize {
+		el := s.lru.Back()
+		if el == nil {
+			return
+		}
+		s.drop(el)
+	}
+}
+
+// drop forgets an entry. Callers hold s.mu.
+func (s *cacheStore) drop(el *list.Element) {
+	item := el.Value.(*storeItem)
+	s.lru.Remove(el)
+	delete(s.items, item.key)
+	s.size -= item.size
+	if s.dir != "" {
+		os.Remove(s.path(item.key))
+	}
+}
+
+func (s *cacheStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.drop(el)
+	}
+}
+
+// deleteMatching drops every entry whose key match accepts and returns how
+// many there were.
+func (s *cacheStore) deleteMatching(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for key, el := range s.items {
+		if match(key) {
+			s.drop(el)
+			n++
+		}
+	}
+	return n
+}
+
+// path is where an entry is stored on disk, named by a hash of its key.
+func (s *cacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// write stores the entry's metadata followed by its body, through a
+// temporary file so readers never see half of it.
+func (s *cacheStore) write(entry *cacheEntry) error {
+	f, err := os.CreateTemp(s.dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	meta := *entry
+	meta.Body = nil
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&meta)
+	if err == nil {
+		_, err = w.Write(entry.Body)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(entry.Key))
+}
+
+// read loads an entry from disk, without its body unless withBody is set.
+func (s *cacheStore) read(path string, withBody bool) (*cacheEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// gob reads no further than the metadata from a bufio.Reader, the rest
+	// is the body
+	r := bufio.NewReader(f)
+	var entry cacheEntry
+	err = gob.NewDecoder(r).Decode(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if withBody {
+		entry.Body, err = io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &entry, nil
+}
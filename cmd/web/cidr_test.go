@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "address", entries: []string{"10.0.0.1"}, want: []string{"10.0.0.1/32"}},
+		{name: "range", entries: []string{"10.0.0.0/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "range with host bits", entries: []string{"10.1.2.3/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "ipv6 address", entries: []string{"2001:db8::1"}, want: []string{"2001:db8::1/128"}},
+		{name: "ipv6 range", entries: []string{"2001:db8::1/32"}, want: []string{"2001:db8::/32"}},
+		{name: "blank entries", entries: []string{" ", " 10.0.0.1 ", ""}, want: []string{"10.0.0.1/32"}},
+		{name: "invalid address", entries: []string{"10.0.0"}, wantErr: true},
+		{name: "hostname", entries: []string{"example.com"}, wantErr: true},
+		{name: "invalid range", entries: []string{"10.0.0.0/33"}, wantErr: true},
+		{name: "invalid ipv6 range", entries: []string{"2001:db8::/129"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := parsePrefixes(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePrefixes(%q) error = %v; want error %t", tt.entries, err, tt.wantErr)
+			}
+			got := []string{}
+			for _, prefix := range prefixes {
+				got = append(got, prefix.String())
+			}
+			if !tt.wantErr && !slices.Equal(got, tt.want) {
+				t.Errorf("parsePrefixes(%q) = %q; want %q", tt.entries, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.2.3", want: true},
+		{ip: "11.0.0.1", want: false},
+		{ip: "192.168.1.1", want: true},
+		{ip: "192.168.1.2", want: false},
+		{ip: "2001:db8::5", want: true},
+		{ip: "2001:db8:ffff::1", want: true},
+		{ip: "2001:db9::1", want: false},
+		{ip: "::ffff:10.0.0.1", want: true},
+		{ip: "[2001:db8::1]", want: false},
+		{ip: "not an address", want: false},
+		{ip: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := containsIP(prefixes, tt.ip); got != tt.want {
+				t.Errorf("containsIP(%q) = %t; want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/haidousm/delne/internal/models"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressionMinSize = 1024
+
+var (
+	defaultCompressionEncodings = []string{"br", "zstd", "gzip"}
+
+	defaultCompressionTypes = []string{
+		"text/html",
+		"text/css",
+		"text/plain",
+		"text/xml",
+		"text/javascript",
+		"text/csv",
+		"text/markdown",
+		"application/javascript",
+		"application/json",
+		"application/ld+json",
+		"application/manifest+json",
+		"application/xml",
+		"application/rss+xml",
+		"application/atom+xml",
+		"application/wasm",
+		"image/svg+xml",
+	}
+)
+
+// encoder is what the gzip, zstd and brotli writers have in common, enough to
+// pool and reuse them.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// levels favour speed, responses are compressed on every request
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() any { return brotli.NewWriterLevel(nil, 4) }},
+	"zstd": {New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+	"gzip": {New: func() any {
+		enc, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return enc
+	}},
+}
+
+// compressHandler compresses the responses of next for clients that accept
+// one of its encodings.
+type compressHandler struct {
+	next      http.Handler
+	encodings []string
+	types     []string
+	minSize   int
+}
+
+// withCompression wraps next if the service compresses responses.
+func withCompression(next http.Handler, cfg models.Compression) http.Handler {
+	if !cfg.Enabled {
+		return next
+	}
+
+	h := &compressHandler{next: next, encodings: cfg.Encodings, types: cfg.ContentTypes, minSize: cfg.MinSize}
+	if len(h.encodings) == 0 {
+		h.encodings = defaultCompressionEncodings
+	}
+	if len(h.types) == 0 {
+		h.types = defaultCompressionTypes
+	}
+	if h.minSize <= 0 {
+		h.minSize = defaultCompressionMinSize
+	}
+	return h
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the client's favourite of ours, the first of them on a tie
+	encoding, best := "", 0.0
+	if r.Method != http.MethodHead {
+		for _, e := range h.encodings {
+			if q := encodingQuality(r, e); q > best {
+				encoding, best = e, q
+			}
+		}
+	}
+
+	cw := &compressWriter{ResponseWriter: w, h: h, encoding: encoding}
+	defer cw.close()
+	h.next.ServeHTTP(cw, r)
+}
+
+// compressible reports whether the media type is on the allow-list.
+func (h *compressHandler) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		// events have to reach the client the moment they are sent
+		return false
+	}
+	for _, t := range h.types {
+		if t == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "*"); ok && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the client accepts the content coding,
+// listed by name or through "*", without refusing it with q=0.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	return encodingQuality(r, coding) > 0
+}
+
+// encodingQuality returns the qvalue Accept-Encoding gives the content coding,
+// 0 when it isn't accepted.
+func encodingQuality(r *http.Request, coding string) float64 {
+	named, wildcard := -1.0, -1.0
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.TrimSpace(name)
+
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(param, "=")
+				if !strings.EqualFold(strings.TrimSpace(key), "q") {
+					continue
+				}
+				// an invalid qvalue is no reason to send an encoding the
+				// client may not understand
+				f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || f < 0 || f > 1 {
+					f = 0
+				}
+				q = f
+			}
+
+			switch {
+			case strings.EqualFold(name, coding):
+				named = max(named, q)
+			case name == "*":
+				wildcard = max(wildcard, q)
+			}
+		}
+	}
+
+	switch {
+	case named >= 0:
+		return named
+	case wildcard >= 0:
+		return wildcard
+	}
+	return 0
+}
+
+// compressWriter holds back the start of the body until it knows whether the
+// response is big enough to be worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	h        *compressHandler
+	encoding string // empty when the client accepts none of ours
+
+	status  int
+	decided bool
+	enc     encoder
+	buf     []byte
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	if code < http.StatusOK {
+		// informational responses go out as they are, a 101 hands the
+		// connection over entirely
+		if code == http.StatusSwitchingProtocols {
+			cw.decided = true
+		}
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.h.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide settles whether to compress and sends the headers along with
+// whatever was held back. big tells whether the body is known to reach the
+// minimum size.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	header := cw.Header()
+
+	eligible := cw.status != http.StatusNoContent &&
+		cw.status != http.StatusPartialContent &&
+		cw.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		!strings.Contains(header.Get("Cache-Control"), "no-transform") &&
+		cw.h.compressible(header.Get("Content-Type"))
+
+	if eligible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		big = length >= cw.h.minSize
+	}
+
+	if eligible && big && cw.encoding != "" {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		// ranges of the compressed body are not ranges of the upstream's
+		header.Del("Accept-Ranges")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// Flush sends what has been written so far, compressing a response of unknown
+// length, as it is likely a stream.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.WriteHeader(http.StatusOK)
+		}
+		if cw.decide(true) != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		if cw.enc.Flush() != nil {
+			return
+		}
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the response once the handler returns.
+func (cw *compressWriter) close() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoderPools[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+func validateCompression(cfg models.Compression) error {
+	for _, e := range cfg.Encodings {
+		if _, ok := encoderPools[e]; !ok {
+			return fmt.Errorf("unsupported encoding %q", e)
+		}
+	}
+	for _, t := range cfg.ContentTypes {
+		if !strings.Contains(t, "/") {
+			return fmt.Errorf("invalid content type %q", t)
+		}
+	}
+	if cfg.MinSize < 0 {
+		return errors.New("minimum size must not be negative")
+	}
+	return nil
+}
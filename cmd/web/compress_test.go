@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestEncodingQuality(t *testing.T) {
+	tests := []struct {
+		accept string
+		coding string
+		want   float64
+	}{
+		{accept: "", coding: "gzip", want: 0},
+		{accept: "gzip", coding: "gzip", want: 1},
+		{accept: "GZIP", coding: "gzip", want: 1},
+		{accept: "gzip;q=0.5", coding: "gzip", want: 0.5},
+		{accept: "gzip; Q=0.5", coding: "gzip", want: 0.5},
+		{accept: "gzip, br;q=0", coding: "br", want: 0},
+		{accept: "br;q=0.000, gzip", coding: "br", want: 0},
+		{accept: "br;q=0.001", coding: "br", want: 0.001},
+		{accept: "br;q=high", coding: "br", want: 0},
+		{accept: "br;q=2", coding: "br", want: 0},
+		{accept: "deflate", coding: "gzip", want: 0},
+		{accept: "*", coding: "zstd", want: 1},
+		{accept: "*;q=0.2", coding: "zstd", want: 0.2},
+		{accept: "*, br;q=0", coding: "br", want: 0},
+		{accept: "br;q=0, *", coding: "br", want: 0},
+		{accept: "gzip;q=0.3, gzip;q=0.8", coding: "gzip", want: 0.8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept+" "+tt.coding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			if got := encodingQuality(r, tt.coding); got != tt.want {
+				t.Errorf("encodingQuality(%q, %q) = %v; want %v", tt.accept, tt.coding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressionEncoding(t *testing.T) {
+	body := strings.Repeat("compressible text ", 200)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Accept-Ranges", "bytes")
+		io.WriteString(w, body)
+	})
+	h := withCompression(upstream, models.Compression{Enabled: true})
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "none accepted", accept: "", want: ""},
+		{name: "only gzip", accept: "gzip", want: "gzip"},
+		{name: "server order on a tie", accept: "gzip, br, zstd", want: "br"},
+		{name: "client preference", accept: "br;q=0.5, gzip", want: "gzip"},
+		{name: "refused", accept: "gzip, br;q=0", want: "gzip"},
+		{name: "all refused", accept: "br;q=0, zstd;q=0, gzip;q=0", want: ""},
+		{name: "wildcard", accept: "*", want: "br"},
+		{name: "wildcard but one", accept: "*, br;q=0", want: "zstd"},
+		{name: "unknown only", accept: "deflate", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.accept != "" {
+				header.Set("Accept-Encoding", tt.accept)
+			}
+			w := serveTest(h, "/", "10.0.0.1", header)
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.want {
+				t.Errorf("Content-Encoding = %q; want %q", got, tt.want)
+			}
+			wantRanges := "bytes"
+			if tt.want != "" {
+				wantRanges = ""
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != wantRanges {
+				t.Errorf("Accept-Ranges = %q; want %q", got, wantRanges)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	requestIDContextKey  = contextKey("requestID")
+	routeContextKey      = contextKey("route")
+	clientIPContextKey   = contextKey("clientIP")
+	hostParamsContextKey = contextKey("hostParams")
+	retryContextKey      = contextKey("retry")
+)
+
+func requestIDFromContext(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// matchedRoute returns the route proxyRequest picked for the request.
+func matchedRoute(r *http.Request) *route {
+	rt, _ := r.Context().Value(routeContextKey).(*route)
+	return rt
+}
+
+// hostParams returns what the matched route's wildcard or regex host captured.
+func hostParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(hostParamsContextKey).(map[string]string)
+	return params
+}
+
+func withRoute(r *http.Request, rt *route, params map[string]string) *http.Request {
+	ctx := context.WithValue(r.Context(), routeContextKey, rt)
+	ctx = context.WithValue(ctx, hostParamsContextKey, params)
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serviceErrorStatuses are the proxy errors a service can replace the page
+// of. Unknown hosts have no service, so their 404 always gets the default.
+var serviceErrorStatuses = []int{
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+var errorPageMessages = map[int]string{
+	http.StatusUnauthorized:          "You need to sign in to access this address.",
+	http.StatusForbidden:             "You don't have access to this address.",
+	http.StatusNotFound:              "There is nothing to see at this address.",
+	http.StatusRequestEntityTooLarge: "The request is larger than this address accepts.",
+	http.StatusTooManyRequests:       "Too many requests, please slow down and try again in a moment.",
+	http.StatusBadGateway:            "The service behind this address could not be reached.",
+	http.StatusServiceUnavailable:    "The service behind this address is unavailable right now, please try again shortly.",
+	http.StatusGatewayTimeout:        "The service behind this address took too long to respond.",
+}
+
+// renderProxyError answers a proxied request the proxy could not serve. JSON
+// clients get a JSON body, everyone else the matched service's page for the
+// status if it has one or the default page.
+func renderProxyError(w http.ResponseWriter, r *http.Request, status int) {
+	requestID := requestIDFromContext(r)
+	message, ok := errorPageMessages[status]
+	if !ok {
+		message = http.StatusText(status)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error     string `json:"error"`
+			Message   string `json:"message"`
+			Status    int    `json:"status"`
+			RequestID string `json:"request_id,omitempty"`
+		}{http.StatusText(status), message, status, requestID})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if rt := matchedRoute(r); rt != nil && rt.errorPages[status] != "" {
+		w.Write([]byte(strings.ReplaceAll(rt.errorPages[status], "{request_id}", requestID)))
+		return
+	}
+	errorPage(status, http.StatusText(status), message, requestID).Render(r.Context(), w)
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML, going by the
+// first of the two media types it lists in Accept.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept"), ","), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "text/html":
+			return false
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamErrorStatus picks the status for a request the upstream failed.
+func upstreamErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		// the client sent more than the service accepts
+		return http.StatusRequestEntityTooLarge
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/haidousm/delne/internal/docker"
+	"github.com/haidousm/delne/internal/models"
+)
+
+// watchContainerEvents keeps the status of services in sync with what docker
+// reports for their containers.
+func (app *application) watchContainerEvents() {
+	go app.dClient.WatchContainerEvents(context.Background(), app.handleContainerEvent)
+}
+
+func (app *application) handleContainerEvent(event docker.ContainerEvent) {
+	service, err := app.services.GetByContainerId(event.ContainerID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logger.Error(err.Error())
+		}
+		// not one of ours
+		return
+	}
+
+	status := service.Status
+	switch event.Action {
+	case docker.START:
+		if !service.IsRunning() {
+			status = models.RUNNING
+		}
+	case docker.DIE, docker.OOM, docker.DESTROY:
+		// deliberate stops and removals flip the status before touching the
+		// container, so anything that was still running went down on its own
+		if service.IsRunning() {
+			status = models.ERROR
+		}
+	case docker.HEALTH_STATUS:
+		if event.Health == "unhealthy" && service.IsRunning() {
+			status = models.ERROR
+		} else if event.Health == "healthy" && service.Status == models.ERROR {
+			status = models.RUNNING
+		}
+	}
+
+	app.logger.Debug("container event", "service", service.Name, "action", event.Action, "exit_code", event.ExitCode, "health", event.Health)
+	if status == service.Status {
+		return
+	}
+
+	err = app.services.UpdateStatus(service.ID, status)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+	app.logger.Info("service status changed", "service", service.Name, "from", service.Status, "to", status, "action", event.Action)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// newTransport returns the transport used to reach the service's upstreams,
+// nil means http.DefaultTransport.
+func newTransport(service models.Service) (http.RoundTripper, error) {
+	if service.Kind != models.KIND_EXTERNAL {
+		if !upstreamTimeouts(service.Timeouts) {
+			return nil, nil
+		}
+		return timeoutTransport(service.Timeouts), nil
+	}
+
+	ext := service.External
+	cfg := &tls.Config{
+		InsecureSkipVerify: ext.InsecureSkipVerify,
+		ServerName:         ext.ServerName,
+	}
+
+	if ext.CAFile != "" {
+		pem, err := os.ReadFile(ext.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", ext.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	transport := timeoutTransport(service.Timeouts)
+	transport.TLSClientConfig = cfg
+	return transport, nil
+}
+
+// validateExternalUrl checks an external upstream points somewhere we can
+// proxy to.
+func validateExternalUrl(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("upstream URL must be http or https")
+	}
+	if u.Host == "" {
+		return errors.New("upstream URL has no host")
+	}
+	return nil
+}
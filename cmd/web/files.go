@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// filesHandler serves the files of a directory on the host.
+type filesHandler struct {
+	cfg    models.FileServer
+	root   http.Dir
+	lister http.Handler
+}
+
+func newFilesHandler(cfg models.FileServer) *filesHandler {
+	root := http.Dir(cfg.Root)
+	return &filesHandler{cfg: cfg, root: root, lister: http.FileServer(visibleFS{root})}
+}
+
+func (h *filesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		renderProxyError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+	if hidden(name) {
+		renderProxyError(w, r, http.StatusNotFound)
+		return
+	}
+
+	info, err := h.stat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		h.fallback(w, r)
+		return
+	case err != nil:
+		renderProxyError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			// relative, so it still works when the route stripped a prefix
+			w.Header().Set("Location", path.Base(name)+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+
+		index := path.Join(name, "index.html")
+		if _, err := h.stat(index); err == nil {
+			h.serveFile(w, r, index)
+			return
+		}
+		if h.cfg.Listing {
+			w.Header().Set("Cache-Control", "no-cache")
+			h.lister.ServeHTTP(w, r)
+			return
+		}
+		h.fallback(w, r)
+		return
+	}
+
+	h.serveFile(w, r, name)
+}
+
+// fallback answers requests for files that don't exist, with the app's
+// index.html in SPA mode.
+func (h *filesHandler) fallback(w http.ResponseWriter, r *http.Request) {
+	if h.cfg.SPA {
+		if _, err := h.stat("/index.html"); err == nil {
+			h.serveFile(w, r, "/index.html")
+			return
+		}
+	}
+	renderProxyError(w, r, http.StatusNotFound)
+}
+
+func (h *filesHandler) stat(name string) (fs.FileInfo, error) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func (h *filesHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+
+	if strings.HasPrefix(contentType, "text/html") || h.cfg.MaxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.cfg.MaxAge.Seconds())))
+	}
+
+	served := name
+	if h.cfg.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, enc := range []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+			if !acceptsEncoding(r, enc.name) {
+				continue
+			}
+			if info, err := h.stat(name + enc.ext); err == nil && !info.IsDir() {
+				served = name + enc.ext
+				w.Header().Set("Content-Encoding", enc.name)
+				break
+			}
+		}
+	}
+
+	f, err := h.root.Open(served)
+	if err != nil {
+		renderProxyError(w, r, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		renderProxyError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if contentType != "" {
+		// ServeContent would guess from the .br/.gz name otherwise
+		w.Header().Set("Content-Type", contentType)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// hidden reports whether any element of the path is a dotfile, which are
+// never served.
+func hidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleFS leaves dotfiles out of directory listings.
+type visibleFS struct {
+	http.FileSystem
+}
+
+func (fsys visibleFS) Open(name string) (http.File, error) {
+	f, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return visibleFile{f}, nil
+}
+
+type visibleFile struct {
+	http.File
+}
+
+func (f visibleFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func validateFileRoot(root string) error {
+	if !filepath.IsAbs(root) {
+		return errors.New("file root must be an absolute path")
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestFilesHandler(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"hello.txt":        "hello",
+		".env":             "SECRET=1",
+		".git/config":      "[core]",
+		"docs/.htpasswd":   "admin:x",
+		"docs/guide.txt":   "guide",
+		"public/.hidden/x": "x",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newFilesHandler(models.FileServer{Root: root, Listing: true})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		code     int
+		contains []string
+		excludes []string
+	}{
+		{name: "file", path: "/hello.txt", code: http.StatusOK, contains: []string{"hello"}},
+		{name: "dotfile", path: "/.env", code: http.StatusNotFound, excludes: []string{"SECRET"}},
+		{name: "file in a dot directory", path: "/.git/config", code: http.StatusNotFound, excludes: []string{"[core]"}},
+		{name: "missing file", path: "/missing.txt", code: http.StatusNotFound, contains: []string{errorPageMessages[http.StatusNotFound]}},
+		{name: "method", method: http.MethodPost, path: "/hello.txt", code: http.StatusMethodNotAllowed},
+		{name: "listing", path: "/", code: http.StatusOK, contains: []string{"hello.txt", "docs/"}, excludes: []string{".env", ".git"}},
+		{name: "nested listing", path: "/docs/", code: http.StatusOK, contains: []string{"guide.txt"}, excludes: []string{".htpasswd"}},
+		{name: "listing without dot directories", path: "/public/", code: http.StatusOK, excludes: []string{".hidden"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(method, tt.path, nil))
+
+			if w.Code != tt.code {
+				t.Errorf("status = %d; want %d", w.Code, tt.code)
+			}
+			if tt.code >= 400 && !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+				t.Errorf("Content-Type = %q; want the error page", w.Header().Get("Content-Type"))
+			}
+			body := w.Body.String()
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("body doesn't contain %q", s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(body, s) {
+					t.Errorf("body contains %q", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,752 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/haidousm/delne/internal/models"
+	"github.com/haidousm/delne/internal/router"
+)
+
+// formInt parses a non-negative integer field, an empty field is 0.
+func formInt(form url.Values, key string) (int, error) {
+	v := strings.TrimSpace(form.Get(key))
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, v)
+	}
+	return n, nil
+}
+
+// formSeconds parses a field holding a number of seconds.
+func formSeconds(form url.Values, key string) (time.Duration, error) {
+	n, err := formInt(form, key)
+	return time.Duration(n) * time.Second, err
+}
+
+// intOrEmpty formats n for a form input, leaving zero values blank so the
+// input's defaults apply.
+func intOrEmpty(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func secondsOrEmpty(d time.Duration) string {
+	return intOrEmpty(int(d.Seconds()))
+}
+
+// parseHealthCheck reads the health check fields of the edit form. Empty
+// fields fall back to the prober's defaults.
+func parseHealthCheck(form url.Values) (models.HealthCheck, error) {
+	check := models.HealthCheck{Path: strings.TrimSpace(form.Get("hc-path"))}
+	if check.Path == "" {
+		return check, nil
+	}
+	if !strings.HasPrefix(check.Path, "/") {
+		return check, errors.New("health check path must start with /")
+	}
+
+	var err error
+	if check.ExpectedStatus, err = formInt(form, "hc-status"); err != nil {
+		return check, err
+	}
+	if check.Interval, err = formSeconds(form, "hc-interval"); err != nil {
+		return check, err
+	}
+	if check.Timeout, err = formSeconds(form, "hc-timeout"); err != nil {
+		return check, err
+	}
+	if check.HealthyThreshold, err = formInt(form, "hc-healthy"); err != nil {
+		return check, err
+	}
+	if check.UnhealthyThreshold, err = formInt(form, "hc-unhealthy"); err != nil {
+		return check, err
+	}
+	return check, nil
+}
+
+func parseCircuitBreaker(form url.Values) (models.CircuitBreaker, error) {
+	var cb models.CircuitBreaker
+	var err error
+	if cb.FailureThreshold, err = formInt(form, "cb-threshold"); err != nil {
+		return cb, err
+	}
+	if cb.OpenDuration, err = formSeconds(form, "cb-open"); err != nil {
+		return cb, err
+	}
+	return cb, nil
+}
+
+// parseHeaderRules reads one rule per line in the form
+// "<request|response> <set|append|remove> <name> [value]". Blank lines and
+// lines starting with # are skipped.
+func parseHeaderRules(text string) ([]models.HeaderRule, error) {
+	rules := []models.HeaderRule{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("header rule on line %d: expected target, action and name", i+1)
+		}
+
+		rule := models.HeaderRule{
+			Target: models.HeaderTarget(strings.ToLower(fields[0])),
+			Action: models.HeaderAction(strings.ToLower(fields[1])),
+			Name:   http.CanonicalHeaderKey(fields[2]),
+		}
+		if len(fields) == 4 {
+			rule.Value = strings.TrimSpace(fields[3])
+		}
+
+		switch {
+		case rule.Target != models.HEADER_REQUEST && rule.Target != models.HEADER_RESPONSE:
+			return nil, fmt.Errorf("header rule on line %d: unknown target %q", i+1, fields[0])
+		case rule.Action != models.HEADER_SET && rule.Action != models.HEADER_APPEND && rule.Action != models.HEADER_REMOVE:
+			return nil, fmt.Errorf("header rule on line %d: unknown action %q", i+1, fields[1])
+		case !validHeaderName(rule.Name):
+			return nil, fmt.Errorf("header rule on line %d: invalid header name %q", i+1, fields[2])
+		case strings.ContainsAny(rule.Value, "\r\n\x00"):
+			return nil, fmt.Errorf("header rule on line %d: invalid header value", i+1)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// validHeaderName reports whether name is an RFC 7230 token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// samePattern reports whether two route patterns are the same, host names
+// being case-insensitive.
+func samePattern(a, b string) bool {
+	hostA, pathA := router.SplitPattern(a)
+	hostB, pathB := router.SplitPattern(b)
+	return hostA == hostB && pathA == pathB
+}
+
+// hasPattern reports whether pattern is one of patterns.
+func hasPattern(patterns []string, pattern string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool { return samePattern(p, pattern) })
+}
+
+// formatHeaderRules is the inverse of parseHeaderRules.
+func formatHeaderRules(rules []models.HeaderRule) string {
+	lines := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		line := fmt.Sprintf("%s %s %s", rule.Target, rule.Action, rule.Name)
+		if rule.Value != "" {
+			line += " " + rule.Value
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parsePathRewrite reads the path handling fields of the edit form. Regex
+// rewrites are given one per line as "<pattern> <replacement>".
+func parsePathRewrite(form url.Values) (models.PathRewrite, error) {
+	rewrite := models.PathRewrite{
+		Mode:   models.PathMode(form.Get("path-mode")),
+		Prefix: strings.TrimSpace(form.Get("path-prefix")),
+		Regex:  []models.RegexRewrite{},
+	}
+	if rewrite.Mode == "" {
+		rewrite.Mode = models.PATH_STRIP
+	}
+	if !rewrite.Mode.Valid() {
+		return rewrite, fmt.Errorf("unknown path mode %q", rewrite.Mode)
+	}
+	if rewrite.Mode == models.PATH_REWRITE && !strings.HasPrefix(rewrite.Prefix, "/") {
+		return rewrite, errors.New("rewrite prefix must start with /")
+	}
+	if rewrite.Mode != models.PATH_REWRITE {
+		rewrite.Prefix = ""
+	}
+
+	for i, line := range strings.Split(form.Get("path-regex"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pattern, replacement, _ := strings.Cut(line, " ")
+		if _, err := regexp.Compile(pattern); err != nil {
+			return rewrite, fmt.Errorf("path rewrite on line %d: %w", i+1, err)
+		}
+		rewrite.Regex = append(rewrite.Regex, models.RegexRewrite{
+			Pattern:     pattern,
+			Replacement: strings.TrimSpace(replacement),
+		})
+	}
+	return rewrite, nil
+}
+
+func formatRegexRewrites(rewrites []models.RegexRewrite) string {
+	lines := make([]string, 0, len(rewrites))
+	for _, rw := range rewrites {
+		lines = append(lines, rw.Pattern+" "+rw.Replacement)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseExternalUpstream reads the upstream fields of an external service's
+// edit form.
+func parseExternalUpstream(form url.Values) (models.ExternalUpstream, error) {
+	external := models.ExternalUpstream{
+		URL:                strings.TrimSpace(form.Get("upstream-url")),
+		InsecureSkipVerify: form.Get("upstream-insecure") == "on",
+		ServerName:         strings.TrimSpace(form.Get("upstream-sni")),
+		CAFile:             strings.TrimSpace(form.Get("upstream-ca")),
+		PreserveHost:       form.Get("upstream-preserve-host") == "on",
+	}
+	return external, validateExternalUrl(external.URL)
+}
+
+func parseRedirect(form url.Values) (models.Redirect, error) {
+	redirect := models.Redirect{
+		URL:          strings.TrimSpace(form.Get("redirect-url")),
+		PreservePath: form.Get("redirect-preserve-path") == "on",
+	}
+
+	var err error
+	if redirect.StatusCode, err = formInt(form, "redirect-status"); err != nil {
+		return redirect, err
+	}
+	return redirect, validateRedirect(redirect)
+}
+
+func parseStaticResponse(form url.Values) (models.StaticResponse, error) {
+	response := models.StaticResponse{
+		ContentType: strings.TrimSpace(form.Get("static-content-type")),
+		Body:        strings.ReplaceAll(form.Get("static-body"), "\r\n", "\n"),
+	}
+
+	var err error
+	if response.StatusCode, err = formInt(form, "static-status"); err != nil {
+		return response, err
+	}
+	if response.StatusCode != 0 && (response.StatusCode < 200 || response.StatusCode > 599) {
+		return response, fmt.Errorf("invalid status code %d", response.StatusCode)
+	}
+	return response, nil
+}
+
+func parseFileServer(form url.Values) (models.FileServer, error) {
+	files := models.FileServer{
+		Root:          strings.TrimSpace(form.Get("files-root")),
+		SPA:           form.Get("files-spa") == "on",
+		Listing:       form.Get("files-listing") == "on",
+		Precompressed: form.Get("files-precompressed") == "on",
+	}
+
+	var err error
+	if files.MaxAge, err = formSeconds(form, "files-max-age"); err != nil {
+		return files, err
+	}
+	return files, validateFileRoot(files.Root)
+}
+
+// parseMaintenance reads the maintenance settings of the edit form, allowed
+// addresses are separated by commas or whitespace.
+func parseMaintenance(form url.Values) (models.Maintenance, error) {
+	maintenance := models.Maintenance{
+		Page:        strings.TrimSpace(form.Get("maint-page")),
+		AllowIPs:    strings.FieldsFunc(form.Get("maint-allow"), func(r rune) bool { return r == ',' || unicode.IsSpace(r) }),
+		BypassToken: strings.TrimSpace(form.Get("maint-token")),
+	}
+
+	var err error
+	if maintenance.RetryAfter, err = formSeconds(form, "maint-retry-after"); err != nil {
+		return maintenance, err
+	}
+	if _, err = parsePrefixes(maintenance.AllowIPs); err != nil {
+		return maintenance, err
+	}
+	return maintenance, nil
+}
+
+// parseErrorPages reads the error-<status> textareas, empty ones fall back to
+// the default page.
+func parseErrorPages(form url.Values) map[int]string {
+	pages := make(map[int]string)
+	for _, status := range serviceErrorStatuses {
+		if page := strings.TrimSpace(form.Get(fmt.Sprintf("error-%d", status))); page != "" {
+			pages[status] = page
+		}
+	}
+	return pages
+}
+
+// parseRateLimits reads one limit per line in the form
+// "<ip|global|header:Name> <requests>/<period> [burst=N] [host=example.com]",
+// where the period is s, m, h or a duration like 10s. Blank lines and lines
+// starting with # are skipped.
+func parseRateLimits(text string, hosts []string) ([]models.RateLimit, error) {
+	limits := []models.RateLimit{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("rate limit on line %d: expected key and rate", i+1)
+		}
+
+		var limit models.RateLimit
+		key, header, _ := strings.Cut(fields[0], ":")
+		limit.Key = models.RateLimitKey(strings.ToLower(key))
+		switch limit.Key {
+		case models.RATE_LIMIT_IP, models.RATE_LIMIT_GLOBAL:
+		case models.RATE_LIMIT_HEADER:
+			limit.Header = http.CanonicalHeaderKey(header)
+		default:
+			return nil, fmt.Errorf("rate limit on line %d: unknown key %q", i+1, fields[0])
+		}
+
+		requests, period, ok := strings.Cut(fields[1], "/")
+		if !ok {
+			return nil, fmt.Errorf("rate limit on line %d: expected a rate like 10/s", i+1)
+		}
+		var err error
+		if limit.Requests, err = strconv.Atoi(requests); err != nil {
+			return nil, fmt.Errorf("rate limit on line %d: invalid request count %q", i+1, requests)
+		}
+		if strings.IndexAny(period, "0123456789") != 0 {
+			period = "1" + period
+		}
+		if limit.Per, err = time.ParseDuration(period); err != nil {
+			return nil, fmt.Errorf("rate limit on line %d: invalid period %q", i+1, period)
+		}
+
+		for _, option := range fields[2:] {
+			name, value, _ := strings.Cut(option, "=")
+			switch name {
+			case "burst":
+				if limit.Burst, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("rate limit on line %d: invalid burst %q", i+1, value)
+				}
+			case "host":
+				limit.Host = value
+			default:
+				return nil, fmt.Errorf("rate limit on line %d: unknown option %q", i+1, option)
+			}
+		}
+
+		if err := validateRateLimit(limit, hosts); err != nil {
+			return nil, fmt.Errorf("rate limit on line %d: %w", i+1, err)
+		}
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
+func formatRateLimit(limit models.RateLimit) string {
+	key := string(limit.Key)
+	if limit.Key == models.RATE_LIMIT_HEADER {
+		key += ":" + limit.Header
+	}
+
+	period := limit.Per.String()
+	switch limit.Per {
+	case time.Second:
+		period = "s"
+	case time.Minute:
+		period = "m"
+	case time.Hour:
+		period = "h"
+	}
+
+	line := fmt.Sprintf("%s %d/%s", key, limit.Requests, period)
+	if limit.Burst > 0 {
+		line += fmt.Sprintf(" burst=%d", limit.Burst)
+	}
+	if limit.Host != "" {
+		line += " host=" + limit.Host
+	}
+	return line
+}
+
+func formatRateLimits(limits []models.RateLimit) string {
+	lines := make([]string, 0, len(limits))
+	for _, limit := range limits {
+		lines = append(lines, formatRateLimit(limit))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseAccessRules reads one rule per line in the form
+// "<allow|deny> <address or range>... [host=example.com]", ranges may also be
+// separated by commas. Blank lines and lines starting with # are skipped.
+func parseAccessRules(text string, hosts []string) ([]models.AccessRule, error) {
+	rules := []models.AccessRule{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+		rule := models.AccessRule{Action: models.AccessAction(strings.ToLower(fields[0])), Ranges: []string{}}
+		if rule.Action != models.ACCESS_ALLOW && rule.Action != models.ACCESS_DENY {
+			return nil, fmt.Errorf("access rule on line %d: unknown action %q", i+1, fields[0])
+		}
+
+		for _, field := range fields[1:] {
+			if host, ok := strings.CutPrefix(field, "host="); ok {
+				rule.Host = host
+				continue
+			}
+			rule.Ranges = append(rule.Ranges, field)
+		}
+
+		switch {
+		case len(rule.Ranges) == 0:
+			return nil, fmt.Errorf("access rule on line %d: expected an address or range", i+1)
+		case rule.Host != "" && !hasPattern(hosts, rule.Host):
+			return nil, fmt.Errorf("access rule on line %d: %s is not one of the service's hosts", i+1, rule.Host)
+		}
+		if _, err := parsePrefixes(rule.Ranges); err != nil {
+			return nil, fmt.Errorf("access rule on line %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func formatAccessRules(rules []models.AccessRule) string {
+	lines := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		line := string(rule.Action) + " " + strings.Join(rule.Ranges, ", ")
+		if rule.Host != "" {
+			line += " host=" + rule.Host
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseAuthGate reads the auth fields. Users are given one per line as
+// "user:password", passwords that aren't bcrypt hashes yet are hashed.
+func parseAuthGate(form url.Values, hosts []string) (models.AuthGate, error) {
+	split := func(r rune) bool { return r == ',' || unicode.IsSpace(r) }
+	gate := models.AuthGate{
+		Mode:           models.AuthMode(form.Get("auth-mode")),
+		Realm:          strings.TrimSpace(form.Get("auth-realm")),
+		Users:          []models.BasicAuthUser{},
+		ForwardURL:     strings.TrimSpace(form.Get("auth-forward-url")),
+		ForwardHeaders: []string{},
+		Hosts:          strings.FieldsFunc(form.Get("auth-hosts"), split),
+	}
+	for _, name := range strings.FieldsFunc(form.Get("auth-forward-headers"), split) {
+		gate.ForwardHeaders = append(gate.ForwardHeaders, http.CanonicalHeaderKey(name))
+	}
+
+	for i, line := range strings.Split(form.Get("auth-users"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" || password == "" {
+			return gate, fmt.Errorf("user on line %d: expected user:password", i+1)
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return gate, fmt.Errorf("user on line %d: %w", i+1, err)
+		}
+		gate.Users = append(gate.Users, models.BasicAuthUser{Username: username, PasswordHash: hash})
+	}
+
+	return gate, validateAuthGate(gate, hosts)
+}
+
+func formatAuthUsers(users []models.BasicAuthUser) string {
+	lines := make([]string, 0, len(users))
+	for _, user := range users {
+		lines = append(lines, user.Username+":"+user.PasswordHash)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseCompression reads the compression settings of the edit form, encodings
+// and content types are separated by commas or whitespace.
+func parseCompression(form url.Values) (models.Compression, error) {
+	split := func(r rune) bool { return r == ',' || unicode.IsSpace(r) }
+	compression := models.Compression{
+		Enabled:      form.Get("comp-enabled") == "on",
+		Encodings:    strings.FieldsFunc(strings.ToLower(form.Get("comp-encodings")), split),
+		ContentTypes: strings.FieldsFunc(strings.ToLower(form.Get("comp-types")), split),
+	}
+
+	var err error
+	if compression.MinSize, err = formInt(form, "comp-min-size"); err != nil {
+		return compression, err
+	}
+	return compression, validateCompression(compression)
+}
+
+// parseCache reads the cache settings of the edit form, the size is given in
+// MiB.
+func parseCache(form url.Values) (models.Cache, error) {
+	cache := models.Cache{
+		Enabled: form.Get("cache-enabled") == "on",
+		Dir:     strings.TrimSpace(form.Get("cache-dir")),
+	}
+
+	size, err := formInt(form, "cache-max-size")
+	if err != nil {
+		return cache, err
+	}
+	cache.MaxSize = int64(size) << 20
+
+	if cache.Dir != "" && !filepath.IsAbs(cache.Dir) {
+		return cache, errors.New("cache directory must be an absolute path")
+	}
+	return cache, nil
+}
+
+// parseRetry reads the retry settings of the edit form. The backoff is given
+// in milliseconds and the max body size in KiB, methods and conditions are
+// separated by commas or whitespace.
+func parseRetry(form url.Values) (models.Retry, error) {
+	split := func(r rune) bool { return r == ',' || unicode.IsSpace(r) }
+	retry := models.Retry{Methods: strings.FieldsFunc(strings.ToUpper(form.Get("retry-methods")), split)}
+	for _, condition := range strings.FieldsFunc(strings.ToLower(form.Get("retry-on")), split) {
+		retry.On = append(retry.On, models.RetryCondition(condition))
+	}
+
+	var err error
+	if retry.Attempts, err = formInt(form, "retry-attempts"); err != nil {
+		return retry, err
+	}
+	backoff, err := formInt(form, "retry-backoff")
+	if err != nil {
+		return retry, err
+	}
+	retry.Backoff = time.Duration(backoff) * time.Millisecond
+	size, err := formInt(form, "retry-max-body")
+	if err != nil {
+		return retry, err
+	}
+	retry.MaxBodySize = int64(size) << 10
+
+	return retry, validateRetry(retry)
+}
+
+func formatRetryConditions(conditions []models.RetryCondition) string {
+	s := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		s = append(s, string(c))
+	}
+	return strings.Join(s, ", ")
+}
+
+// parseTimeouts reads the timeout fields of the edit form, in seconds, and the
+// max body size in MiB.
+func parseTimeouts(form url.Values) (models.Timeouts, error) {
+	timeouts := models.Timeouts{LongLived: form.Get("timeout-long-lived") == "on"}
+
+	var err error
+	if timeouts.Dial, err = formSeconds(form, "timeout-dial"); err != nil {
+		return timeouts, err
+	}
+	if timeouts.ResponseHeader, err = formSeconds(form, "timeout-header"); err != nil {
+		return timeouts, err
+	}
+	if timeouts.Idle, err = formSeconds(form, "timeout-idle"); err != nil {
+		return timeouts, err
+	}
+	if timeouts.Total, err = formSeconds(form, "timeout-total"); err != nil {
+		return timeouts, err
+	}
+	size, err := formInt(form, "timeout-max-body")
+	if err != nil {
+		return timeouts, err
+	}
+	timeouts.MaxBodySize = int64(size) << 20
+	return timeouts, nil
+}
+
+// parseStreaming reads the streaming fields of the edit form, in seconds.
+func parseStreaming(form url.Values) (models.Streaming, error) {
+	var streaming models.Streaming
+	var err error
+	if streaming.PingInterval, err = formSeconds(form, "stream-ping"); err != nil {
+		return streaming, err
+	}
+	if streaming.IdleTimeout, err = formSeconds(form, "stream-idle"); err != nil {
+		return streaming, err
+	}
+	if streaming.DrainTimeout, err = formSeconds(form, "stream-drain"); err != nil {
+		return streaming, err
+	}
+	return streaming, nil
+}
+
+// parseServiceForm applies the edit form to a copy of service. Sections
+// missing from the form are left as they were.
+func parseServiceForm(form url.Values, service models.Service) (models.Service, error) {
+	var err error
+
+	if service.IsContainer() {
+		envVars := make(map[string]string)
+		for key, value := range form {
+			if strings.HasPrefix(key, "env-") && len(key) > len("env-") {
+				envVars[key[len("env-"):]] = value[0]
+			}
+		}
+		if key := form.Get("new-env-key"); key != "" {
+			envVars[key] = form.Get("new-env-value")
+		}
+		service.EnvironmentVariables = &envVars
+	}
+
+	if policy := models.RestartPolicy(form.Get("restart-policy")); policy != "" {
+		if !policy.Valid() {
+			return service, fmt.Errorf("invalid restart policy %q", policy)
+		}
+		service.RestartPolicy = policy
+	}
+
+	if form.Has("replicas") {
+		replicas, err := strconv.Atoi(form.Get("replicas"))
+		if err != nil || replicas < 1 || replicas > maxReplicas {
+			return service, fmt.Errorf("replicas must be between 1 and %d", maxReplicas)
+		}
+		strategy := models.LBStrategy(form.Get("lb-strategy"))
+		if !strategy.Valid() {
+			return service, fmt.Errorf("invalid load balancing strategy %q", strategy)
+		}
+		service.Replicas = replicas
+		service.LBStrategy = strategy
+	}
+
+	if form.Has("hc-path") {
+		if service.HealthCheck, err = parseHealthCheck(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("cb-threshold") {
+		if service.CircuitBreaker, err = parseCircuitBreaker(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("header-rules") {
+		if service.HeaderRules, err = parseHeaderRules(form.Get("header-rules")); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("rate-limits") {
+		if service.RateLimits, err = parseRateLimits(form.Get("rate-limits"), service.Hosts); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("access-rules") {
+		if service.AccessRules, err = parseAccessRules(form.Get("access-rules"), service.Hosts); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("auth-mode") {
+		if service.Auth, err = parseAuthGate(form, service.Hosts); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("comp-min-size") {
+		if service.Compression, err = parseCompression(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("cache-max-size") {
+		if service.Cache, err = parseCache(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("retry-attempts") {
+		if service.Retry, err = parseRetry(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("timeout-total") {
+		if service.Timeouts, err = parseTimeouts(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("stream-drain") {
+		if service.Streaming, err = parseStreaming(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("path-mode") {
+		if service.PathRewrite, err = parsePathRewrite(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("maint-retry-after") {
+		// toggled from the services table, not the edit form
+		enabled := service.Maintenance.Enabled
+		if service.Maintenance, err = parseMaintenance(form); err != nil {
+			return service, err
+		}
+		service.Maintenance.Enabled = enabled
+	}
+	if form.Has("error-502") {
+		service.ErrorPages = parseErrorPages(form)
+	}
+
+	if form.Has("upstream-url") {
+		if service.External, err = parseExternalUpstream(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("redirect-url") {
+		if service.Redirect, err = parseRedirect(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("files-root") {
+		if service.Files, err = parseFileServer(form); err != nil {
+			return service, err
+		}
+	}
+	if form.Has("static-status") {
+		if service.StaticResponse, err = parseStaticResponse(form); err != nil {
+			return service, err
+		}
+	}
+	return service, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestParseServiceForm(t *testing.T) {
+	service := models.Service{
+		Kind:                 models.KIND_CONTAINER,
+		RestartPolicy:        models.RESTART_ALWAYS,
+		Replicas:             1,
+		LBStrategy:           models.ROUND_ROBIN,
+		EnvironmentVariables: &map[string]string{"PORT": "8080"},
+	}
+	base := url.Values{
+		"restart-policy": {string(models.RESTART_ALWAYS)},
+		"replicas":       {"1"},
+		"lb-strategy":    {string(models.ROUND_ROBIN)},
+		"env-PORT":       {"8080"},
+	}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		wantErr  bool
+		recreate bool
+	}{
+		{name: "unchanged", form: url.Values{}},
+		{name: "proxy settings only", form: url.Values{"lb-strategy": {string(models.RANDOM)}, "comp-min-size": {"1024"}}},
+		{name: "environment variable", form: url.Values{"env-PORT": {"9090"}}, recreate: true},
+		{name: "new environment variable", form: url.Values{"new-env-key": {"DEBUG"}, "new-env-value": {"1"}}, recreate: true},
+		{name: "replicas", form: url.Values{"replicas": {"3"}}, recreate: true},
+		{name: "restart policy", form: url.Values{"restart-policy": {string(models.RESTART_NEVER)}}, recreate: true},
+		{name: "invalid replicas", form: url.Values{"replicas": {"0"}}, wantErr: true},
+		{name: "invalid later section", form: url.Values{"env-PORT": {"9090"}, "comp-min-size": {"lots"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			for k, v := range base {
+				form[k] = v
+			}
+			for k, v := range tt.form {
+				form[k] = v
+			}
+
+			updated, err := parseServiceForm(form, service)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseServiceForm() error = %v; want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := containerSettingsChanged(service, updated); got != tt.recreate {
+				t.Errorf("containerSettingsChanged() = %t; want %t", got, tt.recreate)
+			}
+			if (*service.EnvironmentVariables)["PORT"] != "8080" {
+				t.Errorf("the original service's variables were changed")
+			}
+		})
+	}
+}
+
+func TestContainerSettingsChanged(t *testing.T) {
+	one, alsoOne, two := 1, 1, 2
+	env := &map[string]string{}
+
+	tests := []struct {
+		name     string
+		old, new *int
+		recreate bool
+	}{
+		{name: "same image", old: &one, new: &alsoOne},
+		{name: "new image", old: &one, new: &two, recreate: true},
+		{name: "image added", new: &one, recreate: true},
+		{name: "no image", old: nil, new: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := models.Service{ImageID: tt.old, EnvironmentVariables: env}
+			updated := models.Service{ImageID: tt.new, EnvironmentVariables: env}
+			if got := containerSettingsChanged(old, updated); got != tt.recreate {
+				t.Errorf("containerSettingsChanged() = %t; want %t", got, tt.recreate)
+			}
+		})
+	}
+}
+
+func TestSamePattern(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "example.com/", true},
+		{"Example.com/api", "example.com/api", true},
+		{"example.com/API", "example.com/api", false},
+		{"example.com/api", "example.com", false},
+		{"*.Example.com", "*.example.com", true},
+		{`~[a-z]+\.example\.com`, `~[a-z]+\.example\.com`, true},
+		{`~[A-Z]+\.example\.com`, `~[a-z]+\.example\.com`, false},
+	}
+
+	for _, tt := range tests {
+		if got := samePattern(tt.a, tt.b); got != tt.want {
+			t.Errorf("samePattern(%q, %q) = %t; want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func (app *application) isTrustedProxy(ip string) bool {
+	return containsIP(app.trustedProxies, ip)
+}
+
+// setForwardedHeaders tells the upstream who the request is really from and
+// how it reached us. Forwarding headers sent by a trusted proxy are kept and
+// extended, anyone else's are dropped so clients cannot spoof them. prefix is
+// the path prefix the route strips before proxying.
+//
+// The client address it settles on is stored in the request context, where
+// clientIP picks it up.
+func (app *application) setForwardedHeaders(r *http.Request, prefix string) *http.Request {
+	peer := peerIP(r)
+	trusted := app.isTrustedProxy(peer)
+	if !trusted {
+		for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Prefix", "Forwarded", "X-Real-IP"} {
+			r.Header.Del(h)
+		}
+	}
+
+	client := peer
+	if trusted {
+		client = app.forwardedClientIP(r, peer)
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// the reverse proxy appends the peer to X-Forwarded-For itself
+	if r.Header.Get("X-Forwarded-Proto") == "" {
+		r.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if r.Header.Get("X-Forwarded-Host") == "" {
+		r.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if prefix != "" {
+		r.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")+prefix)
+	}
+	r.Header.Set("X-Real-IP", client)
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(peer), forwardedValue(r.Host), proto)
+	if existing := r.Header.Get("Forwarded"); existing != "" {
+		element = existing + ", " + element
+	}
+	r.Header.Set("Forwarded", element)
+
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey, client))
+}
+
+// forwardedClientIP walks X-Forwarded-For from the nearest hop backwards and
+// returns the first address that is not one of our trusted proxies. A hop that
+// isn't an address ends the walk at the last trusted one. X-Real-IP is not
+// consulted, a trusted proxy passes along whatever its client sent.
+func (app *application) forwardedClientIP(r *http.Request, peer string) string {
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			return peer
+		}
+		if !app.isTrustedProxy(hop) {
+			return hop
+		}
+		peer = hop
+	}
+	return peer
+}
+
+// forwardedNode formats an address as an RFC 7239 node, IPv6 addresses have
+// to be bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes v unless it is a valid RFC 7239 token.
+func forwardedValue(v string) string {
+	if validHeaderName(v) {
+		return v
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
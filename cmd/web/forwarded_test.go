@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestApp(t *testing.T, trustedProxies ...string) *application {
+	t.Helper()
+	prefixes, err := parsePrefixes(trustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &application{trustedProxies: prefixes}
+}
+
+// requestFrom returns a request for example.com sent by the peer at ip.
+func requestFrom(ip string, header http.Header) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "example.com"
+	r.RemoteAddr = net.JoinHostPort(ip, "1234")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	return r
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	app := newTestApp(t, "10.0.0.0/8", "fd00::/8")
+
+	tests := []struct {
+		name   string
+		peer   string
+		header http.Header
+		prefix string
+
+		client    string
+		realIP    string
+		xff       string
+		forwarded string
+		proto     string
+		host      string
+		xfPrefix  string
+	}{
+		{
+			name:      "direct client",
+			peer:      "203.0.113.5",
+			client:    "203.0.113.5",
+			realIP:    "203.0.113.5",
+			forwarded: "for=203.0.113.5;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name: "untrusted peer spoofing every header",
+			peer: "203.0.113.5",
+			header: http.Header{
+				"X-Forwarded-For":    {"198.51.100.7"},
+				"X-Real-Ip":          {"198.51.100.7"},
+				"Forwarded":          {"for=198.51.100.7"},
+				"X-Forwarded-Proto":  {"https"},
+				"X-Forwarded-Host":   {"evil.com"},
+				"X-Forwarded-Prefix": {"/admin"},
+			},
+			prefix:    "/api",
+			client:    "203.0.113.5",
+			realIP:    "203.0.113.5",
+			forwarded: "for=203.0.113.5;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+			xfPrefix:  "/api",
+		},
+		{
+			name:      "trusted proxy",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-For": {"198.51.100.7"}, "Forwarded": {"for=198.51.100.7"}, "X-Forwarded-Proto": {"https"}},
+			client:    "198.51.100.7",
+			realIP:    "198.51.100.7",
+			xff:       "198.51.100.7",
+			forwarded: "for=198.51.100.7, for=10.0.0.2;host=example.com;proto=http",
+			proto:     "https",
+			host:      "example.com",
+		},
+		{
+			name:      "client spoofing through a trusted proxy",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.0.0.3"}},
+			client:    "198.51.100.7",
+			realIP:    "198.51.100.7",
+			xff:       "1.2.3.4, 198.51.100.7, 10.0.0.3",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "several forwarded headers",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-For": {"1.2.3.4", "198.51.100.7"}},
+			client:    "198.51.100.7",
+			realIP:    "198.51.100.7",
+			xff:       "1.2.3.4",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "real ip from a trusted proxy",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Real-Ip": {"198.51.100.9"}, "X-Forwarded-For": {"198.51.100.7"}},
+			client:    "198.51.100.7",
+			realIP:    "198.51.100.7",
+			xff:       "198.51.100.7",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "spoofed real ip through a trusted proxy",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Real-Ip": {"1.2.3.4"}},
+			client:    "10.0.0.2",
+			realIP:    "10.0.0.2",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "garbage in forwarded for",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-For": {"198.51.100.7, not-an-ip, 10.0.0.3"}},
+			client:    "10.0.0.3",
+			realIP:    "10.0.0.3",
+			xff:       "198.51.100.7, not-an-ip, 10.0.0.3",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "only trusted hops",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-For": {"10.0.0.9"}},
+			client:    "10.0.0.9",
+			realIP:    "10.0.0.9",
+			xff:       "10.0.0.9",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "trusted proxy without headers",
+			peer:      "10.0.0.2",
+			client:    "10.0.0.2",
+			realIP:    "10.0.0.2",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "ipv6 client",
+			peer:      "2001:db8::1",
+			header:    http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+			client:    "2001:db8::1",
+			realIP:    "2001:db8::1",
+			forwarded: `for="[2001:db8::1]";host=example.com;proto=http`,
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "ipv6 trusted proxy",
+			peer:      "fd00::1",
+			header:    http.Header{"X-Forwarded-For": {"2001:db8::2, fd00::3"}},
+			client:    "2001:db8::2",
+			realIP:    "2001:db8::2",
+			xff:       "2001:db8::2, fd00::3",
+			forwarded: `for="[fd00::1]";host=example.com;proto=http`,
+			proto:     "http",
+			host:      "example.com",
+		},
+		{
+			name:      "prefix behind a trusted proxy",
+			peer:      "10.0.0.2",
+			header:    http.Header{"X-Forwarded-Prefix": {"/outer/"}, "X-Forwarded-Host": {"public.example.com"}},
+			prefix:    "/api",
+			client:    "10.0.0.2",
+			realIP:    "10.0.0.2",
+			forwarded: "for=10.0.0.2;host=example.com;proto=http",
+			proto:     "http",
+			host:      "public.example.com",
+			xfPrefix:  "/outer/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := app.setForwardedHeaders(requestFrom(tt.peer, tt.header), tt.prefix)
+
+			if got := clientIP(r); got != tt.client {
+				t.Errorf("clientIP() = %q; want %q", got, tt.client)
+			}
+			for _, h := range []struct{ name, want string }{
+				{"X-Real-IP", tt.realIP},
+				{"X-Forwarded-For", tt.xff},
+				{"Forwarded", tt.forwarded},
+				{"X-Forwarded-Proto", tt.proto},
+				{"X-Forwarded-Host", tt.host},
+				{"X-Forwarded-Prefix", tt.xfPrefix},
+			} {
+				if got := r.Header.Get(h.name); got != h.want {
+					t.Errorf("%s = %q; want %q", h.name, got, h.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// headerRewriter applies a service's header rules around the next handler.
+type headerRewriter struct {
+	next     http.Handler
+	request  []models.HeaderRule
+	response []models.HeaderRule
+}
+
+// withHeaderRules wraps next so the rules are applied to every request it
+// serves, or returns next unchanged when there are none.
+func withHeaderRules(next http.Handler, rules []models.HeaderRule) http.Handler {
+	h := &headerRewriter{next: next}
+	for _, rule := range rules {
+		switch rule.Target {
+		case models.HEADER_REQUEST:
+			h.request = append(h.request, rule)
+		case models.HEADER_RESPONSE:
+			h.response = append(h.response, rule)
+		}
+	}
+	if len(h.request) == 0 && len(h.response) == 0 {
+		return next
+	}
+	return h
+}
+
+func (h *headerRewriter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := headerVars(r)
+	applyHeaderRules(r.Header, h.request, vars)
+
+	if len(h.response) > 0 {
+		w = &headerWriter{ResponseWriter: w, rules: h.response, vars: vars}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// headerVars expands the placeholders header rule values may use. Besides the
+// fixed ones, anything a wildcard or regex host captured is available, e.g.
+// {label} or a named group like {tenant}.
+func headerVars(r *http.Request) *strings.Replacer {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	vars := []string{
+		"{client_ip}", clientIP(r),
+		"{request_id}", requestIDFromContext(r),
+		"{host}", strings.ToLower(host),
+	}
+	for k, v := range hostParams(r) {
+		vars = append(vars, "{"+k+"}", v)
+	}
+	return strings.NewReplacer(vars...)
+}
+
+func applyHeaderRules(header http.Header, rules []models.HeaderRule, vars *strings.Replacer) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case models.HEADER_SET:
+			header.Set(rule.Name, vars.Replace(rule.Value))
+		case models.HEADER_APPEND:
+			header.Add(rule.Name, vars.Replace(rule.Value))
+		case models.HEADER_REMOVE:
+			header.Del(rule.Name)
+		}
+	}
+}
+
+// headerWriter applies response rules right before the headers are sent, after
+// the upstream's headers have been copied over.
+type headerWriter struct {
+	http.ResponseWriter
+	rules   []models.HeaderRule
+	vars    *strings.Replacer
+	applied bool
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	// informational responses are followed by the real one
+	if !w.applied && code >= 200 {
+		w.applied = true
+		applyHeaderRules(w.Header(), w.rules, w.vars)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which the
+// reverse proxy needs for flushing and protocol upgrades.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
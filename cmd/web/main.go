@@ -7,7 +7,7 @@ import (
 	"log"
 	"log/slog"
 	"net/http"
-	"net/http/httputil"
+	"net/netip"
 	"os"
 	"time"
 
@@ -34,6 +34,12 @@ type config struct {
 	Debug bool
 	DSN   string
 	SSL   SSLConfig
+
+	ReconcileInterval time.Duration
+
+	// TrustedProxies are addresses or CIDR ranges of proxies in front of
+	// delne whose forwarding headers are passed on instead of replaced.
+	TrustedProxies []string
 }
 
 type application struct {
@@ -42,8 +48,11 @@ type application struct {
 	proxy   *Proxy
 	dClient *docker.Client
 
-	images   models.ImageModelInterface
-	services models.ServiceModelInterface
+	trustedProxies []netip.Prefix
+
+	images      models.ImageModelInterface
+	services    models.ServiceModelInterface
+	corrections models.CorrectionModelInterface
 }
 
 var (
@@ -81,6 +90,12 @@ func main() {
 	}
 	defer db.Close()
 
+	trustedProxies, err := parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	dClient, err := docker.NewClient(logger)
 	if err != nil {
 		logger.Error(err.Error())
@@ -88,24 +103,24 @@ func main() {
 	}
 
 	app := &application{
-		config: cfg,
-		logger: logger,
-		proxy: &Proxy{
-			Target: map[string]string{
-				"foo.local/test": "http://localhost:8020",
-			},
-			RevProxy: make(map[string]*httputil.ReverseProxy),
-		},
-		images:   &models.ImageModel{DB: db},
-		services: &models.ServiceModel{DB: db},
-		dClient:  dClient,
+		config:      cfg,
+		logger:      logger,
+		proxy:       NewProxy(logger),
+		images:      &models.ImageModel{DB: db},
+		services:    &models.ServiceModel{DB: db},
+		corrections: &models.CorrectionModel{DB: db},
+		dClient:     dClient,
+
+		trustedProxies: trustedProxies,
 	}
 
+	app.proxy.OnHealthChange = app.upstreamHealthChanged
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/admin/", app.routes().ServeHTTP)
 	mux.HandleFunc("/", app.proxyRequest)
 
-	standardMiddleware := alice.New(app.recoverPanic, app.logRequest)
+	standardMiddleware := alice.New(app.recoverPanic, app.requestID, app.logRequest)
 
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", 443),
@@ -116,7 +131,9 @@ func main() {
 		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelError),
 	}
 
-	// app.rebuildProxyFromDB()
+	app.rebuildProxyFromDB()
+	app.watchContainerEvents()
+	app.startReconciler(cfg.ReconcileInterval)
 
 	listenAndServeTLS(srv, app)
 	os.Exit(1)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+
+	// a bypass token in the query string is swapped for a cookie, so it only
+	// has to be shared as a link
+	maintenanceBypassParam  = "delne_bypass"
+	maintenanceBypassCookie = "delne_bypass"
+)
+
+// maintenanceHandler serves the maintenance page instead of next, except to
+// clients that are allowed through.
+type maintenanceHandler struct {
+	next       http.Handler
+	service    string
+	page       string
+	retryAfter time.Duration
+	allow      []netip.Prefix
+	token      string
+}
+
+// withMaintenance wraps next if the service is in maintenance.
+func withMaintenance(next http.Handler, service string, cfg models.Maintenance) (http.Handler, error) {
+	if !cfg.Enabled {
+		return next, nil
+	}
+
+	allow, err := parsePrefixes(cfg.AllowIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &maintenanceHandler{
+		next:       next,
+		service:    service,
+		page:       cfg.Page,
+		retryAfter: cfg.RetryAfter,
+		allow:      allow,
+		token:      cfg.BypassToken,
+	}
+	if h.retryAfter <= 0 {
+		h.retryAfter = defaultMaintenanceRetryAfter
+	}
+	return h, nil
+}
+
+func (h *maintenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bypass := r.URL.Query().Get(maintenanceBypassParam)
+	cookie, _ := r.Cookie(maintenanceBypassCookie)
+	stripBypass(r)
+
+	if containsIP(h.allow, clientIP(r)) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if h.token != "" {
+		if h.validToken(bypass) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     maintenanceBypassCookie,
+				Value:    h.token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			h.next.ServeHTTP(w, r)
+			return
+		}
+		if cookie != nil && h.validToken(cookie.Value) {
+			h.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(h.retryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if h.page != "" {
+		w.Write([]byte(h.page))
+		return
+	}
+	maintenancePage(h.service).Render(r.Context(), w)
+}
+
+func (h *maintenanceHandler) validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
+
+// stripBypass removes the bypass token from r, it is meant for us and not the
+// upstream.
+func stripBypass(r *http.Request) {
+	if r.URL.RawQuery != "" {
+		params := strings.Split(r.URL.RawQuery, "&")
+		params = slices.DeleteFunc(params, func(param string) bool {
+			key, _, _ := strings.Cut(param, "=")
+			key, err := url.QueryUnescape(key)
+			return err == nil && key == maintenanceBypassParam
+		})
+		r.URL.RawQuery = strings.Join(params, "&")
+	}
+
+	cookies := r.Cookies()
+	kept := slices.DeleteFunc(slices.Clone(cookies), func(c *http.Cookie) bool {
+		return c.Name == maintenanceBypassCookie
+	})
+	if len(kept) == len(cookies) {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, c := range kept {
+		r.AddCookie(c)
+	}
+}
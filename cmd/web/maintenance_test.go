@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestMaintenanceStripsBypass(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		path   string
+		cookie string
+
+		query     string
+		upstream  string // the Cookie header next sees
+		setCookie bool
+	}{
+		{
+			name:      "token in the query",
+			ip:        "203.0.113.5",
+			path:      "/?a=1&delne_bypass=secret&b=2",
+			query:     "a=1&b=2",
+			setCookie: true,
+		},
+		{
+			name:     "token in a cookie",
+			ip:       "203.0.113.5",
+			path:     "/",
+			cookie:   "session=abc; delne_bypass=secret; theme=dark",
+			upstream: "session=abc; theme=dark",
+		},
+		{
+			name:   "allowed ip with a stale token",
+			ip:     "10.0.0.1",
+			path:   "/?delne_bypass=old",
+			cookie: "delne_bypass=old",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query, cookie string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query, cookie = r.URL.RawQuery, r.Header.Get("Cookie")
+			})
+			h, err := withMaintenance(next, "app", models.Maintenance{Enabled: true, BypassToken: "secret", AllowIPs: []string{"10.0.0.1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			header := http.Header{}
+			if tt.cookie != "" {
+				header.Set("Cookie", tt.cookie)
+			}
+			w := serveTest(h, tt.path, tt.ip, header)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+			}
+			if query != tt.query {
+				t.Errorf("query = %q; want %q", query, tt.query)
+			}
+			if cookie != tt.upstream {
+				t.Errorf("Cookie = %q; want %q", cookie, tt.upstream)
+			}
+			if got := w.Header().Get("Set-Cookie") != ""; got != tt.setCookie {
+				t.Errorf("set a cookie = %t; want %t", got, tt.setCookie)
+			}
+		})
+	}
+}
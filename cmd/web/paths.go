@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// pathRewriter maps the path a client requested onto the upstream's path.
+type pathRewriter struct {
+	mode   models.PathMode
+	prefix string
+	regex  []compiledRewrite
+}
+
+type compiledRewrite struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func newPathRewriter(cfg models.PathRewrite) (*pathRewriter, error) {
+	p := &pathRewriter{mode: cfg.Mode, prefix: strings.TrimSuffix(cfg.Prefix, "/")}
+	if p.mode == "" {
+		p.mode = models.PATH_STRIP
+	}
+
+	for _, rw := range cfg.Regex {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.regex = append(p.regex, compiledRewrite{re: re, replacement: rw.Replacement})
+	}
+	return p, nil
+}
+
+// rewrite returns the upstream path for a request to path, of which the route
+// matched prefix and left rest. removed is the part of the client's path the
+// upstream won't see, for X-Forwarded-Prefix.
+func (p *pathRewriter) rewrite(path, prefix, rest string) (upstream, removed string) {
+	switch p.mode {
+	case models.PATH_PRESERVE:
+		upstream = path
+	case models.PATH_REWRITE:
+		upstream, removed = p.prefix+rest, prefix
+	default:
+		upstream, removed = rest, prefix
+	}
+
+	for _, rw := range p.regex {
+		upstream = rw.re.ReplaceAllString(upstream, rw.replacement)
+	}
+	if !strings.HasPrefix(upstream, "/") {
+		upstream = "/" + upstream
+	}
+	return upstream, removed
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = 2 * time.Second
+)
+
+// startHealthChecks probes every upstream of the balancer until it is closed,
+// ejecting upstreams that keep failing and bringing them back once they
+// recover. onChange is called with the number of healthy upstreams whenever
+// an upstream flips.
+func (b *balancer) startHealthChecks(check models.HealthCheck, onChange func(healthy, total int)) {
+	if check.Interval <= 0 {
+		check.Interval = defaultProbeInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = defaultProbeTimeout
+	}
+	check.HealthyThreshold = max(check.HealthyThreshold, 1)
+	check.UnhealthyThreshold = max(check.UnhealthyThreshold, 1)
+
+	client := &http.Client{
+		Transport: b.transport,
+		Timeout:   check.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, u := range b.upstreams {
+		go b.probe(u, check, client, onChange)
+	}
+}
+
+func (b *balancer) probe(u *upstream, check models.HealthCheck, client *http.Client, onChange func(healthy, total int)) {
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	target := u.url.JoinPath(check.Path).String()
+	successes, failures := 0, 0
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if probeOnce(client, target, check.ExpectedStatus) {
+			successes, failures = successes+1, 0
+		} else {
+			successes, failures = 0, failures+1
+		}
+
+		changed := false
+		switch {
+		case failures >= check.UnhealthyThreshold && u.healthy.Load():
+			u.healthy.Store(false)
+			changed = true
+		case successes >= check.HealthyThreshold && !u.healthy.Load():
+			u.healthy.Store(true)
+			changed = true
+		}
+
+		if changed && onChange != nil {
+			onChange(b.healthyCount(), len(b.upstreams))
+		}
+	}
+}
+
+func (b *balancer) healthyCount() int {
+	n := 0
+	for _, u := range b.upstreams {
+		if u.healthy.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+func probeOnce(client *http.Client, target string, expected int) bool {
+	resp, err := client.Get(target)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	if expected == 0 {
+		return resp.StatusCode >= 200 && resp.StatusCode < 400
+	}
+	return resp.StatusCode == expected
+}
+
+// upstreamHealthChanged marks a service as degraded while any of its replicas
+// is failing its health checks.
+func (app *application) upstreamHealthChanged(name string, healthy, total int) {
+	app.logger.Info("upstream health changed", "service", name, "healthy", healthy, "total", total)
+
+	service, err := app.services.GetByName(name)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	status := service.Status
+	switch {
+	case healthy < total && service.Status == models.RUNNING:
+		status = models.DEGRADED
+	case healthy == total && service.Status == models.DEGRADED:
+		status = models.RUNNING
+	}
+
+	if status == service.Status {
+		return
+	}
+
+	err = app.services.UpdateStatus(service.ID, status)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
@@ -2,116 +2,323 @@ package main
 
 import (
 	"errors"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/docker/docker/api/types"
 	"github.com/haidousm/delne/internal/models"
+	"github.com/haidousm/delne/internal/router"
 )
 
+// Proxy holds the routing table used by proxyRequest. The table is an
+// immutable snapshot: writers build a modified copy and swap it in atomically,
+// so readers never take a lock and never observe a half-updated table.
 type Proxy struct {
-	Target   map[string]string
-	RevProxy map[string]*httputil.ReverseProxy
+	mu     sync.Mutex // serializes writers
+	table  atomic.Pointer[routingTable]
+	logger *slog.Logger
+
+	cachesMu sync.Mutex
+	caches   map[string]*httpCache // by service
+
+	streamsMu sync.Mutex
+	streams   map[string]*streamTracker // by service
+
+	// OnHealthChange is called when a health checked replica of a service is
+	// ejected from or brought back into rotation.
+	OnHealthChange func(service string, healthy, total int)
+}
+
+// routingTable must not be modified once it has been published by the Proxy.
+type routingTable struct {
+	routes map[string]*route
+	tree   *router.Tree[*route]
 }
 
-func (app *application) RemoveService(service models.Service) {
-	for k, v := range app.proxy.Target {
-		if v == service.Name {
-			delete(app.proxy.Target, k)
-			break
+type route struct {
+	key     string // host with an optional path prefix, e.g. "foo.local/test"
+	service string
+	handler http.Handler
+	paths   *pathRewriter
+	lb      *balancer
+
+	limiters   []*rateLimiter
+	blocked    *atomic.Uint64 // requests the access rules turned away
+	errorPages map[int]string
+}
+
+func NewProxy(logger *slog.Logger) *Proxy {
+	p := &Proxy{logger: logger.With("source", "proxy"), caches: map[string]*httpCache{}, streams: map[string]*streamTracker{}}
+	p.table.Store(newRoutingTable(map[string]*route{}))
+	return p
+}
+
+func newRoutingTable(routes map[string]*route) *routingTable {
+	tree := router.New[*route]()
+	for k, r := range routes {
+		tree.Insert(k, r)
+	}
+	return &routingTable{routes: routes, tree: tree}
+}
+
+func (p *Proxy) snapshot() *routingTable {
+	return p.table.Load()
+}
+
+// update applies fn to a copy of the current routes and publishes the result.
+func (p *Proxy) update(fn func(routes map[string]*route)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := p.table.Load()
+	routes := make(map[string]*route, len(current.routes))
+	for k, v := range current.routes {
+		routes[k] = v
+	}
+
+	fn(routes)
+	p.table.Store(newRoutingTable(routes))
+}
+
+// SetService registers every host of the service, replacing any routes the
+// service previously had.
+func (p *Proxy) SetService(service models.Service) error {
+	for _, host := range service.Hosts {
+		if err := router.ValidPattern(host); err != nil {
+			return err
 		}
 	}
 
-	for k := range app.proxy.RevProxy {
-		if k == service.Name {
-			delete(app.proxy.RevProxy, k)
-			break
+	paths, err := newPathRewriter(service.PathRewrite)
+	if err != nil {
+		return err
+	}
+
+	access, err := compileAccessRules(service.AccessRules)
+	if err != nil {
+		return err
+	}
+
+	cache, err := p.serviceCache(service)
+	if err != nil {
+		return err
+	}
+
+	handler, lb, err := p.serviceHandler(service)
+	if err != nil {
+		return err
+	}
+
+	handler = withCompression(withCache(handler, cache), service.Compression)
+	handler, err = withMaintenance(handler, service.Name, service.Maintenance)
+	if err != nil {
+		if lb != nil {
+			lb.close()
 		}
+		return err
 	}
-}
 
-func (app *application) proxyRequest(w http.ResponseWriter, r *http.Request) {
-	p := app.proxy
+	p.update(func(routes map[string]*route) {
+		limiters := rateLimiters(service.RateLimits, serviceLimiters(routes, service.Name))
+		blocked := serviceBlocked(routes, service.Name)
+		removeServiceRoutes(routes, service.Name)
+		for _, host := range service.Hosts {
+			hostLimiters := limitersFor(limiters, host)
+			handler := withAccessRules(withRateLimits(withAuth(handler, host, service.Auth, p.logger), hostLimiters), service.Name, host, access, blocked, p.logger)
+			handler = withTimeouts(withHeaderRules(handler, service.HeaderRules), service.Timeouts)
+			routes[host] = &route{key: host, service: service.Name, handler: handler, paths: paths, lb: lb, limiters: hostLimiters, blocked: blocked, errorPages: service.ErrorPages}
+		}
+	})
+	return nil
+}
 
-	host := r.Host
-	if r.URL.Path != "/" {
-		host += r.URL.Path
+// serviceHandler builds what answers a service's requests. Proxied services
+// also get the balancer, which has to be closed once it is no longer routed to.
+func (p *Proxy) serviceHandler(service models.Service) (http.Handler, *balancer, error) {
+	switch service.Kind {
+	case models.KIND_REDIRECT:
+		h, err := newRedirectHandler(service.Redirect)
+		return h, nil, err
+	case models.KIND_STATIC:
+		return newStaticHandler(service.StaticResponse), nil, nil
+	case models.KIND_FILES:
+		return newFilesHandler(service.Files), nil, nil
 	}
 
-	services, err := app.services.GetAll()
+	lb, err := newBalancer(service, p.logger)
 	if err != nil {
-		app.serverError(w, r, err)
-		return
+		return nil, nil, err
+	}
+
+	if service.HealthCheck.Enabled() {
+		lb.startHealthChecks(service.HealthCheck, func(healthy, total int) {
+			if p.OnHealthChange != nil {
+				p.OnHealthChange(service.Name, healthy, total)
+			}
+		})
+	}
+	return withStreams(lb, p.serviceStreams(service), service.Streaming, service.Timeouts), lb, nil
+}
+
+// serviceStreams returns the tracker of a service's streams, keeping the one
+// it already has so streams opened before a redeploy can still be drained.
+func (p *Proxy) serviceStreams(service models.Service) *streamTracker {
+	p.streamsMu.Lock()
+	defer p.streamsMu.Unlock()
+
+	t, ok := p.streams[service.Name]
+	if !ok {
+		t = newStreamTracker()
+		p.streams[service.Name] = t
+	}
+	t.setDrainTimeout(service.Streaming.DrainTimeout)
+	return t
+}
+
+// StreamStats describes the WebSocket and other upgraded connections and
+// event streams of a service.
+func (p *Proxy) StreamStats(name string) streamStats {
+	p.streamsMu.Lock()
+	t := p.streams[name]
+	p.streamsMu.Unlock()
+
+	if t == nil {
+		return streamStats{}
+	}
+	return t.stats()
+}
+
+// DrainService asks the clients of a service's open streams to disconnect
+// before its upstreams go away. It only waits for the clients to be told,
+// the streams get the service's drain timeout to close in the background.
+func (p *Proxy) DrainService(name string) {
+	p.streamsMu.Lock()
+	t := p.streams[name]
+	p.streamsMu.Unlock()
+
+	if t != nil {
+		t.drain(p.logger.With("service", name))
+	}
+}
+
+func (p *Proxy) RemoveService(name string) {
+	p.update(func(routes map[string]*route) {
+		removeServiceRoutes(routes, name)
+	})
+}
+
+// removeServiceRoutes deletes the routes of a service and stops their
+// balancers. Requests already holding the old snapshot are still served.
+func removeServiceRoutes(routes map[string]*route, name string) {
+	for k, r := range routes {
+		if r.service == name {
+			if r.lb != nil {
+				r.lb.close()
+			}
+			delete(routes, k)
+		}
 	}
+}
 
-	// prefix matching
-	for k := range p.Target {
-		if len(k) > len(host) {
+// serviceLimiters returns the distinct rate limiters of a service's routes.
+func serviceLimiters(routes map[string]*route, name string) []*rateLimiter {
+	limiters := []*rateLimiter{}
+	for _, r := range routes {
+		if r.service != name {
 			continue
 		}
-		if k == host[:len(k)] {
-			r.URL.Path = host[len(k):]
-			if rev, ok := p.RevProxy[k]; ok {
-				app.logger.Debug("proxying request to existing rev proxy")
-				rev.ServeHTTP(w, r)
-				return
+		for _, l := range r.limiters {
+			if !slices.Contains(limiters, l) {
+				limiters = append(limiters, l)
 			}
-			if target, ok := p.Target[k]; ok {
-				app.logger.Debug("proxying request to new rev proxy")
-
-				// find service with name == target
-				var service *models.Service
-				for _, s := range services {
-					if s.Name == target {
-						service = s
-						break
-					}
-				}
+		}
+	}
+	return limiters
+}
 
-				if service == nil {
-					app.logger.Error("service not found", "name", target)
-					app.notFound(w)
-					return
-				}
+// serviceBlocked returns the blocked request counter of a service's routes, or
+// a new one if it has none yet.
+func serviceBlocked(routes map[string]*route, name string) *atomic.Uint64 {
+	for _, r := range routes {
+		if r.service == name && r.blocked != nil {
+			return r.blocked
+		}
+	}
+	return &atomic.Uint64{}
+}
 
-				sUrl := service.Url()
-				remote, err := url.Parse(sUrl)
-				if err != nil {
-					app.serverError(w, r, err)
-					return
-				}
+// BlockedRequests returns how many requests the service's access rules have
+// turned away.
+func (p *Proxy) BlockedRequests(name string) uint64 {
+	for _, r := range p.snapshot().routes {
+		if r.service == name && r.blocked != nil {
+			return r.blocked.Load()
+		}
+	}
+	return 0
+}
+
+// RateLimitStats returns the counters of a service's rate limits, in the order
+// they are configured.
+func (p *Proxy) RateLimitStats(service models.Service) []rateLimitStats {
+	limiters := serviceLimiters(p.snapshot().routes, service.Name)
 
-				rev := httputil.NewSingleHostReverseProxy(remote)
-				p.RevProxy[host] = rev
-				rev.ServeHTTP(w, r)
-				return
+	stats := []rateLimitStats{}
+	for _, cfg := range service.RateLimits {
+		for _, l := range limiters {
+			if l.cfg == cfg {
+				stats = append(stats, rateLimitStats{Limit: cfg, Allowed: l.allowed.Load(), Limited: l.limited.Load(), Clients: l.clients()})
+				break
 			}
 		}
 	}
+	return stats
+}
 
-	err = errors.New("forbidden host")
-	app.logger.Error(err.Error())
-	app.notFound(w)
+// match returns the most specific route for the host and path, along with the
+// route's prefix, the path left over once it is stripped and whatever a
+// wildcard or regex host captured.
+func (t *routingTable) match(host, path string) (*route, string, string, map[string]string) {
+	rt, prefix, rest, params, ok := t.tree.Match(host, path)
+	if !ok {
+		return nil, "", "", nil
+	}
+	return rt, prefix, rest, params
 }
 
-func (app *application) rebuildProxyFromDB() {
+func (app *application) proxyRequest(w http.ResponseWriter, r *http.Request) {
+	rt, prefix, rest, params := app.proxy.snapshot().match(r.Host, r.URL.Path)
+	if rt == nil {
+		err := errors.New("forbidden host")
+		app.logger.Error(err.Error(), "host", r.Host, "path", r.URL.Path)
+		renderProxyError(w, r, http.StatusNotFound)
+		return
+	}
+
+	path, removed := rt.paths.rewrite(r.URL.Path, prefix, rest)
+	r = app.setForwardedHeaders(r, removed)
+	r.URL.Path = path
+	r.URL.RawPath = ""
+	rt.handler.ServeHTTP(w, withRoute(r, rt, params))
+}
 
+// rebuildProxyFromDB restores the routing table after a restart. Services whose
+// containers are still around are adopted by ID; anything else gets fresh
+// containers, which register their routes once they are running.
+func (app *application) rebuildProxyFromDB() {
 	containers, err := app.dClient.ListContainers()
 	if err != nil {
 		app.logger.Error(err.Error())
 		return
 	}
 
-	filtered := []types.Container{}
+	byId := map[string]types.Container{}
 	for _, c := range containers {
-		if c.HostConfig.NetworkMode == "delne" && c.Names[0][1:] != "delne" {
-			filtered = append(filtered, c)
-		}
-	}
-
-	for _, c := range filtered {
-		app.dClient.RemoveContainerById(c.ID)
+		byId[c.ID] = c
 	}
 
 	services, err := app.services.GetAll()
@@ -126,7 +333,41 @@ func (app *application) rebuildProxyFromDB() {
 		return
 	}
 
+	// containers named after a service's replica but not tracked by it are
+	// leftovers that would block recreating the service's containers
+	for _, c := range containers {
+		for _, service := range services {
+			if service.IsContainer() && isReplicaOf(c, service) && !slices.Contains(service.ContainerIds, c.ID) {
+				app.logger.Debug("removing stale container", "service", service.Name, "id", c.ID)
+				if err := app.dClient.RemoveContainerById(c.ID); err != nil {
+					app.logger.Error(err.Error())
+				}
+			}
+		}
+	}
+
 	for _, service := range services {
+		if !service.IsContainer() {
+			if service.IsRunning() {
+				if err := app.proxy.SetService(*service); err != nil {
+					app.logger.Error(err.Error(), "service", service.Name)
+				}
+			}
+			continue
+		}
+
+		if app.adoptContainers(service, byId) {
+			continue
+		}
+
+		if service.Status == models.STOPPED {
+			// nothing to run, but keep the hosts routable for when it is started
+			if err := app.proxy.SetService(*service); err != nil {
+				app.logger.Error(err.Error())
+			}
+			continue
+		}
+
 		var image *models.Image
 		for _, i := range images {
 			if i.ID == *service.ImageID {
@@ -134,6 +375,62 @@ func (app *application) rebuildProxyFromDB() {
 				break
 			}
 		}
+		if image == nil {
+			app.logger.Error("image not found", "service", service.Name, "image_id", *service.ImageID)
+			continue
+		}
+
+		app.dClient.RemoveContainer(*service)
 		go app.createContainerForService(service, image)
 	}
 }
+
+// adoptContainers registers a service whose containers survived the restart.
+// It reports false when any replica is missing or unusable and the service
+// should be recreated.
+func (app *application) adoptContainers(service *models.Service, byId map[string]types.Container) bool {
+	if len(service.ContainerIds) != max(service.Replicas, 1) {
+		return false
+	}
+
+	stopped := []string{}
+	for _, id := range service.ContainerIds {
+		c, ok := byId[id]
+		if !ok || strings.Contains(c.Status, "(unhealthy)") {
+			return false
+		}
+		if c.State != "running" {
+			stopped = append(stopped, id)
+		}
+	}
+
+	// a stopped service keeps its containers stopped on purpose
+	if service.Status != models.STOPPED {
+		for _, id := range stopped {
+			err := app.dClient.StartContainerById(id)
+			if err != nil {
+				app.logger.Error(err.Error(), "service", service.Name)
+				return false
+			}
+		}
+		app.services.UpdateStatus(service.ID, models.RUNNING)
+	}
+
+	err := app.proxy.SetService(*service)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return false
+	}
+
+	app.logger.Debug("adopted containers", "service", service.Name, "ids", service.ContainerIds)
+	return true
+}
+
+func isReplicaOf(c types.Container, service *models.Service) bool {
+	for _, n := range c.Names {
+		if service.IsReplicaName(strings.TrimPrefix(n, "/")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// rateLimiter is a set of token buckets sharing one rate limit, one bucket per
+// client IP, header value or a single one for global limits.
+type rateLimiter struct {
+	cfg   models.RateLimit
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	allowed atomic.Uint64
+	limited atomic.Uint64
+}
+
+// maxBuckets bounds the clients a limiter keeps track of, header limits are
+// keyed by whatever the clients send.
+const maxBuckets = 10000
+
+// overflowBucket is the key of the bucket clients share once a limiter is
+// full. It can't collide with the ip: and h: keys.
+const overflowBucket = "overflow"
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(cfg models.RateLimit) *rateLimiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.Requests
+	}
+	return &rateLimiter{
+		cfg:     cfg,
+		rate:    float64(cfg.Requests) / cfg.Per.Seconds(),
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// key returns the bucket a request counts against. Requests without the
+// header of a header limit are counted by client IP instead, so leaving the
+// header out doesn't get around the limit.
+func (l *rateLimiter) key(r *http.Request) string {
+	switch l.cfg.Key {
+	case models.RATE_LIMIT_GLOBAL:
+		return ""
+	case models.RATE_LIMIT_HEADER:
+		if v := r.Header.Get(l.cfg.Header); v != "" {
+			return "h:" + v
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// peek reports whether the key's bucket has a token for a request, without
+// spending it. It also returns the tokens that would be left and how long
+// until the bucket is full again.
+func (l *rateLimiter) peek(key string, now time.Time) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tokens := l.bucket(key, now).tokens
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	reset := time.Duration((l.burst - tokens) / l.rate * float64(time.Second))
+	return allowed, int(tokens), reset
+}
+
+// take spends a token from the key's bucket. It reports false if another
+// request got to the last one since peek.
+func (l *rateLimiter) take(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund puts back a token take spent on a request that was rejected after
+// all.
+func (l *rateLimiter) refund(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key, now)
+	b.tokens = math.Min(l.burst, b.tokens+1)
+}
+
+// bucket returns the key's bucket, refilled up to now. Once a limiter tracks
+// maxBuckets clients, new ones share a single overflow bucket until the next
+// sweep makes room. l.mu must be held.
+func (l *rateLimiter) bucket(key string, now time.Time) *bucket {
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxBuckets {
+		key = overflowBucket
+		b, ok = l.buckets[key]
+	}
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// sweep drops buckets that have refilled completely, they are no different
+// from a fresh one. It runs at most once per refill period.
+func (l *rateLimiter) sweep(now time.Time) {
+	fill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < max(fill, time.Minute) {
+		return
+	}
+	l.lastSweep = now
+
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= fill {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *rateLimiter) clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// policy describes the limit for the RateLimit-Policy header.
+func (l *rateLimiter) policy() string {
+	return fmt.Sprintf("%d;w=%d", l.cfg.Requests, int(math.Ceil(l.cfg.Per.Seconds())))
+}
+
+// rateLimitHandler rejects requests over any of its limits with a 429 before
+// they reach next.
+type rateLimitHandler struct {
+	next     http.Handler
+	limiters []*rateLimiter
+}
+
+// withRateLimits wraps next if there are limits to enforce.
+func withRateLimits(next http.Handler, limiters []*rateLimiter) http.Handler {
+	if len(limiters) == 0 {
+		return next
+	}
+	return &rateLimitHandler{next: next, limiters: limiters}
+}
+
+func (h *rateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	// the headers describe the limit that rejected the request, or else
+	// whichever is closest to running out
+	var closest *rateLimiter
+	keys := make([]string, len(h.limiters))
+	remaining, reset, allowed := 0, time.Duration(0), true
+	for i, l := range h.limiters {
+		keys[i] = l.key(r)
+		ok, left, until := l.peek(keys[i], now)
+		if closest == nil || (allowed && !ok) || (allowed == ok && left < remaining) {
+			closest, remaining, reset = l, left, until
+		}
+		if !ok {
+			l.limited.Add(1)
+		}
+		allowed = allowed && ok
+	}
+
+	if allowed {
+		allowed = h.take(keys, now)
+	}
+
+	resetSeconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	w.Header().Set("RateLimit-Policy", closest.policy())
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(int(closest.burst)))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", resetSeconds)
+
+	if !allowed {
+		// a single token is back well before the bucket is full
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(1/closest.rate)))))
+		renderProxyError(w, r, http.StatusTooManyRequests)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// take spends a token from every limiter. Tokens are only kept once every
+// limit lets the request through, so a request rejected by one limit doesn't
+// count against the others.
+func (h *rateLimitHandler) take(keys []string, now time.Time) bool {
+	for i, l := range h.limiters {
+		if l.take(keys[i], now) {
+			continue
+		}
+		// another request got to the last token since peek
+		l.limited.Add(1)
+		for j, taken := range h.limiters[:i] {
+			taken.refund(keys[j], now)
+		}
+		return false
+	}
+	for _, l := range h.limiters {
+		l.allowed.Add(1)
+	}
+	return true
+}
+
+// rateLimiters builds the limiters of a service, reusing those of its previous
+// routes whose limit didn't change so buckets and counters survive redeploys.
+func rateLimiters(limits []models.RateLimit, previous []*rateLimiter) []*rateLimiter {
+	limiters := make([]*rateLimiter, 0, len(limits))
+	for _, cfg := range limits {
+		var l *rateLimiter
+		for _, p := range previous {
+			if p.cfg == cfg {
+				l = p
+				break
+			}
+		}
+		if l == nil {
+			l = newRateLimiter(cfg)
+		}
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// limitersFor returns the limiters that apply to requests for host.
+func limitersFor(limiters []*rateLimiter, host string) []*rateLimiter {
+	matching := []*rateLimiter{}
+	for _, l := range limiters {
+		if l.cfg.Host == "" || samePattern(l.cfg.Host, host) {
+			matching = append(matching, l)
+		}
+	}
+	return matching
+}
+
+// rateLimitStats are the counters of a rate limit since it was configured.
+type rateLimitStats struct {
+	Limit   models.RateLimit
+	Allowed uint64
+	Limited uint64
+	Clients int
+}
+
+func validateRateLimit(limit models.RateLimit, hosts []string) error {
+	switch {
+	case limit.Requests <= 0 || limit.Per <= 0:
+		return errors.New("rate limit must allow at least one request per period")
+	case limit.Burst < 0:
+		return errors.New("rate limit burst must not be negative")
+	case limit.Key == models.RATE_LIMIT_HEADER && !validHeaderName(limit.Header):
+		return fmt.Errorf("invalid rate limit header %q", limit.Header)
+	}
+	if limit.Host != "" && !hasPattern(hosts, limit.Host) {
+		return fmt.Errorf("%s is not one of the service's hosts", limit.Host)
+	}
+	return nil
+}
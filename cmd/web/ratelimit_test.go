@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestRateLimitHandler(t *testing.T) {
+	perIP := models.RateLimit{Key: models.RATE_LIMIT_IP, Requests: 1, Per: time.Minute}
+	global := models.RateLimit{Key: models.RATE_LIMIT_GLOBAL, Requests: 3, Per: time.Minute}
+
+	tests := []struct {
+		name   string
+		limits []models.RateLimit
+		ips    []string
+		want   []int
+	}{
+		{
+			name:   "single limit",
+			limits: []models.RateLimit{perIP},
+			ips:    []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			want:   []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:   "rejected by the first limit spends nothing from the second",
+			limits: []models.RateLimit{perIP, global},
+			ips:    []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			want: []int{
+				http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests,
+				http.StatusOK, http.StatusOK, http.StatusTooManyRequests,
+			},
+		},
+		{
+			name:   "rejected by the second limit spends nothing from the first",
+			limits: []models.RateLimit{global, perIP},
+			ips:    []string{"10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			want: []int{
+				http.StatusOK, http.StatusTooManyRequests,
+				http.StatusOK, http.StatusOK, http.StatusTooManyRequests,
+			},
+		},
+		{
+			name:   "rejected by both",
+			limits: []models.RateLimit{perIP, {Key: models.RATE_LIMIT_GLOBAL, Requests: 1, Per: time.Minute}},
+			ips:    []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			want:   []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := withRateLimits(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), rateLimiters(tt.limits, nil))
+
+			for i, ip := range tt.ips {
+				w := serveTest(h, "/", ip, nil)
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d from %s = %d; want %d", i+1, ip, w.Code, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitTakeRefunds(t *testing.T) {
+	perKey := newRateLimiter(models.RateLimit{Key: models.RATE_LIMIT_IP, Requests: 1, Per: time.Minute})
+	global := newRateLimiter(models.RateLimit{Key: models.RATE_LIMIT_GLOBAL, Requests: 1, Per: time.Minute})
+	h := &rateLimitHandler{limiters: []*rateLimiter{perKey, global}}
+	keys := []string{"ip:10.0.0.1", ""}
+	now := time.Now()
+
+	// a concurrent request spends the global token between peek and take
+	if !global.take("", now) {
+		t.Fatal("global limit has no token")
+	}
+	if h.take(keys, now) {
+		t.Fatal("take() = true with the global limit spent")
+	}
+
+	if ok, _, _ := perKey.peek(keys[0], now); !ok {
+		t.Error("the per client token wasn't refunded")
+	}
+	if got := perKey.allowed.Load() + global.allowed.Load(); got != 0 {
+		t.Errorf("allowed = %d; want 0", got)
+	}
+	if got := global.limited.Load(); got != 1 {
+		t.Errorf("global limited = %d; want 1", got)
+	}
+}
+
+func TestRateLimitMaxBuckets(t *testing.T) {
+	l := newRateLimiter(models.RateLimit{Key: models.RATE_LIMIT_HEADER, Header: "X-Api-Key", Requests: 1, Per: time.Minute})
+	now := time.Now()
+
+	for i := 0; i < maxBuckets; i++ {
+		if !l.take(fmt.Sprintf("h:%d", i), now) {
+			t.Fatalf("client %d was limited", i)
+		}
+	}
+
+	// past the limit new clients share a bucket
+	if !l.take("h:new", now) {
+		t.Error("the first new client was limited")
+	}
+	if l.take("h:newer", now) {
+		t.Error("the second new client wasn't limited")
+	}
+	if got := l.clients(); got != maxBuckets+1 {
+		t.Errorf("clients() = %d; want %d", got, maxBuckets+1)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultReconcileInterval = 30 * time.Second
+	// maxRestarts is how many consecutive restarts a crashing service gets
+	// before the reconciler gives up and marks it as errored.
+	maxRestarts = 5
+)
+
+// startReconciler periodically compares the services table (desired state)
+// with the containers docker knows about (actual state) and corrects any drift.
+func (app *application) startReconciler(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultReconcileInterval
+	}
+
+	// only ever touched by the reconciler goroutine
+	restarts := map[int]int{}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			app.reconcile(restarts)
+		}
+	}()
+}
+
+func (app *application) reconcile(restarts map[int]int) {
+	containers, err := app.dClient.ListContainers()
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	byId := map[string]types.Container{}
+	for _, c := range containers {
+		byId[c.ID] = c
+	}
+
+	services, err := app.services.GetAll()
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	for _, service := range services {
+		if !service.IsContainer() {
+			continue
+		}
+
+		switch service.Status {
+		case models.RUNNING, models.DEGRADED, models.ERROR:
+			// ERROR usually means the events listener saw a container go
+			// down, which the restart policy still applies to
+			app.reconcileRunning(service, byId, restarts)
+		case models.STOPPED:
+			for _, id := range service.ContainerIds {
+				if c, ok := byId[id]; ok && c.State == "running" {
+					err := app.dClient.StopContainer(*service)
+					if err != nil {
+						app.logger.Error(err.Error(), "service", service.Name)
+						break
+					}
+					app.recordCorrection(service, models.STOPPED_CONTAINER, "container was running while the service is stopped")
+					break
+				}
+			}
+		default:
+			// PULLING and CREATED are owned by createContainerForService
+		}
+	}
+}
+
+func (app *application) reconcileRunning(service *models.Service, byId map[string]types.Container, restarts map[int]int) {
+	replicas := max(service.Replicas, 1)
+	missing := replicas - len(service.ContainerIds)
+	exited := []types.Container{}
+	for _, id := range service.ContainerIds {
+		c, ok := byId[id]
+		if !ok {
+			missing++
+			continue
+		}
+		switch c.State {
+		case "running", "restarting", "removing", "paused":
+		default:
+			exited = append(exited, c)
+		}
+	}
+
+	if missing == 0 && len(exited) == 0 {
+		delete(restarts, service.ID)
+		return
+	}
+
+	if restarts[service.ID] >= maxRestarts {
+		app.markStatus(service, models.ERROR, fmt.Sprintf("gave up after %d attempts", maxRestarts))
+		return
+	}
+
+	if missing > 0 {
+		if len(service.ContainerIds) == 0 {
+			// the containers were never created, most likely a bad image
+			return
+		}
+
+		image, err := app.images.Get(*service.ImageID)
+		if err != nil {
+			app.logger.Error(err.Error(), "service", service.Name)
+			return
+		}
+
+		restarts[service.ID]++
+		app.services.UpdateStatus(service.ID, models.PULLING)
+		app.recordCorrection(service, models.RECREATED, fmt.Sprintf("%d of %d containers are missing", missing, replicas))
+
+		// the surviving replicas are recreated too so their names are free
+		app.dClient.RemoveContainer(*service)
+		go app.createContainerForService(service, image)
+		return
+	}
+
+	restarted, cleanExits := 0, 0
+	for _, c := range exited {
+		state, err := app.dClient.GetContainerState(c.ID)
+		if err != nil {
+			app.logger.Error(err.Error(), "service", service.Name)
+			continue
+		}
+
+		reason := fmt.Sprintf("container %s %s with exit code %d", c.ID[:12], c.State, state.ExitCode)
+
+		switch {
+		case service.RestartPolicy == models.RESTART_NEVER:
+			app.markStatus(service, models.ERROR, reason+", restart policy is never")
+			return
+		case service.RestartPolicy == models.RESTART_ON_FAILURE && state.ExitCode == 0 && !state.OOMKilled:
+			cleanExits++
+			continue
+		}
+
+		err = app.dClient.StartContainerById(c.ID)
+		if err != nil {
+			app.logger.Error(err.Error(), "service", service.Name)
+			continue
+		}
+		restarted++
+		app.recordCorrection(service, models.RESTARTED, reason)
+	}
+
+	if restarted > 0 {
+		restarts[service.ID]++
+	}
+	if cleanExits == replicas {
+		app.markStatus(service, models.STOPPED, "every container exited cleanly, not restarting")
+	}
+}
+
+// markStatus records a status change, unless the service already has it.
+func (app *application) markStatus(service *models.Service, status models.ServiceStatus, reason string) {
+	if service.Status == status {
+		return
+	}
+
+	err := app.services.UpdateStatus(service.ID, status)
+	if err != nil {
+		app.logger.Error(err.Error(), "service", service.Name)
+		return
+	}
+	app.recordCorrection(service, models.MARKED_STATUS, fmt.Sprintf("%s -> %s: %s", service.Status, status, reason))
+}
+
+func (app *application) recordCorrection(service *models.Service, action models.CorrectionAction, reason string) {
+	app.logger.Info("reconciled service", "service", service.Name, "action", action, "reason", reason)
+
+	_, err := app.corrections.Insert(service.ID, service.Name, action, reason)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// redirectHandler answers every request with a redirect.
+type redirectHandler struct {
+	target *url.URL
+	code   int
+	keep   bool // append the request's path and query
+}
+
+func newRedirectHandler(cfg models.Redirect) (*redirectHandler, error) {
+	target, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	code := cfg.StatusCode
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
+	return &redirectHandler{target: target, code: code, keep: cfg.PreservePath}, nil
+}
+
+func (h *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := *h.target
+	if h.keep {
+		target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+		target.RawPath = ""
+		if r.URL.RawQuery != "" {
+			target.RawQuery = r.URL.RawQuery
+		}
+	}
+	http.Redirect(w, r, target.String(), h.code)
+}
+
+// staticHandler answers every request with the same response.
+type staticHandler struct {
+	code        int
+	contentType string
+	body        []byte
+}
+
+func newStaticHandler(cfg models.StaticResponse) *staticHandler {
+	h := &staticHandler{code: cfg.StatusCode, contentType: cfg.ContentType, body: []byte(cfg.Body)}
+	if h.code == 0 {
+		h.code = http.StatusOK
+	}
+	if h.contentType == "" {
+		h.contentType = "text/plain; charset=utf-8"
+	}
+	return h
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", h.contentType)
+	w.WriteHeader(h.code)
+	if r.Method != http.MethodHead {
+		w.Write(h.body)
+	}
+}
+
+func validRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func validateRedirect(redirect models.Redirect) error {
+	u, err := url.Parse(redirect.URL)
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return errors.New("redirect URL must be absolute")
+	}
+	if redirect.StatusCode != 0 && !validRedirectCode(redirect.StatusCode) {
+		return errors.New("redirect status must be 301, 302, 303, 307 or 308")
+	}
+	return nil
+}
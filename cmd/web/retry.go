@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultRetryBackoff     = 100 * time.Millisecond
+	defaultRetryMaxBodySize = 1 << 20
+)
+
+var (
+	defaultRetryMethods = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodOptions,
+		http.MethodPut,
+		http.MethodDelete,
+		http.MethodTrace,
+	}
+	defaultRetryOn = []models.RetryCondition{models.RETRY_CONNECT, models.RETRY_RESET}
+
+	// errRetryStatus stands in for a 502, 503 or 504 response that is going
+	// to be retried, so the reverse proxy drops it like a failed request.
+	errRetryStatus = errors.New("upstream responded with a retryable status")
+)
+
+// retryPolicy is a models.Retry with its defaults filled in.
+type retryPolicy struct {
+	attempts    int
+	backoff     time.Duration
+	methods     []string
+	on          []models.RetryCondition
+	maxBodySize int64
+}
+
+// newRetryPolicy returns nil if the service doesn't retry requests.
+func newRetryPolicy(cfg models.Retry) *retryPolicy {
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	p := &retryPolicy{
+		attempts:    cfg.Attempts,
+		backoff:     cfg.Backoff,
+		methods:     cfg.Methods,
+		on:          cfg.On,
+		maxBodySize: cfg.MaxBodySize,
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultRetryBackoff
+	}
+	if len(p.methods) == 0 {
+		p.methods = defaultRetryMethods
+	}
+	if len(p.on) == 0 {
+		p.on = defaultRetryOn
+	}
+	if p.maxBodySize <= 0 {
+		p.maxBodySize = defaultRetryMaxBodySize
+	}
+	return p
+}
+
+// applies reports whether r may be retried. Upgrades are not, the upstream
+// owns the connection once it switched protocols.
+func (p *retryPolicy) applies(r *http.Request) bool {
+	return p != nil && slices.Contains(p.methods, r.Method) && r.Header.Get("Upgrade") == ""
+}
+
+// retryAttempt is a single try of a request the balancer may send again. The
+// upstream's reverse proxy finds it in the request context.
+type retryAttempt struct {
+	policy *retryPolicy
+	last   bool
+	err    error // why the attempt is being retried
+}
+
+func retryAttemptFromContext(r *http.Request) *retryAttempt {
+	a, _ := r.Context().Value(retryContextKey).(*retryAttempt)
+	return a
+}
+
+// retriesOn reports whether the attempt is followed by another one on the
+// given kind of failure.
+func (a *retryAttempt) retriesOn(condition models.RetryCondition) bool {
+	return a != nil && !a.last && slices.Contains(a.policy.on, condition)
+}
+
+// retry records err as the reason to try the request again and reports
+// whether it is one, in which case the client is not told about it.
+func (a *retryAttempt) retry(r *http.Request, err error) bool {
+	if r.Context().Err() != nil || !a.retriesOn(retryCondition(err)) {
+		return false
+	}
+	a.err = err
+	return true
+}
+
+// retryCondition classifies a failed upstream request.
+func retryCondition(err error) models.RetryCondition {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errRetryStatus):
+		return models.RETRY_STATUS
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.As(err, &dnsErr):
+		return models.RETRY_CONNECT
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return models.RETRY_TIMEOUT
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return models.RETRY_RESET
+	}
+	return ""
+}
+
+func retryStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// serveWithRetries proxies r, sending it again after the failures the retry
+// policy covers, to a replica it wasn't sent to yet when there is one.
+func (b *balancer) serveWithRetries(w http.ResponseWriter, r *http.Request) {
+	body, ok := bufferBody(r, b.retry.maxBodySize)
+	if !ok {
+		// too big to hold on to, it gets a single try
+		b.serve(w, r, b.pick(r, nil))
+		return
+	}
+
+	tried := make([]*upstream, 0, b.retry.attempts+1)
+	backoff := b.retry.backoff
+	for attempt := 0; ; attempt++ {
+		u := b.pick(r, tried)
+		if u == nil {
+			b.serve(w, r, nil)
+			return
+		}
+		tried = append(tried, u)
+
+		a := &retryAttempt{policy: b.retry, last: attempt == b.retry.attempts}
+		req := r.WithContext(context.WithValue(r.Context(), retryContextKey, a))
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+
+		b.serve(w, req, u)
+		if a.err == nil {
+			return
+		}
+
+		b.logger.Info("retrying upstream request", "upstream", u.url.Host, "attempt", attempt+1, "backoff", backoff.String(), "error", a.err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-r.Context().Done():
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// bufferBody reads the body of r so it can be sent more than once. It
+// reports false, leaving the body as it was, when it is bigger than maxSize
+// or could not be read.
+func bufferBody(r *http.Request, maxSize int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxSize {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil || int64(len(body)) > maxSize {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// readCloser reads from one reader and closes another, to put back what was
+// already read from a request body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func validateRetry(cfg models.Retry) error {
+	for _, method := range cfg.Methods {
+		if !validHeaderName(method) || strings.ToUpper(method) != method {
+			return fmt.Errorf("invalid method %q", method)
+		}
+	}
+	for _, condition := range cfg.On {
+		switch condition {
+		case models.RETRY_CONNECT, models.RETRY_RESET, models.RETRY_TIMEOUT, models.RETRY_STATUS:
+		default:
+			return fmt.Errorf("unknown retry condition %q", condition)
+		}
+	}
+	if cfg.Backoff < 0 || cfg.MaxBodySize < 0 {
+		return errors.New("backoff and max body size must not be negative")
+	}
+	return nil
+}
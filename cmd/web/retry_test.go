@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+func TestServeWithRetries(t *testing.T) {
+	retry := models.Retry{Attempts: 2, Backoff: time.Millisecond, On: []models.RetryCondition{models.RETRY_STATUS}, MaxBodySize: 8}
+
+	tests := []struct {
+		name     string
+		retry    models.Retry
+		method   string
+		body     string
+		failures int // requests the upstream answers with a 503
+
+		status int
+		tries  int
+	}{
+		{name: "success", retry: retry, method: http.MethodGet, status: http.StatusOK, tries: 1},
+		{name: "recovers", retry: retry, method: http.MethodGet, failures: 2, status: http.StatusOK, tries: 3},
+		{name: "out of attempts", retry: retry, method: http.MethodGet, failures: 5, status: http.StatusServiceUnavailable, tries: 3},
+		{name: "method not retried", retry: retry, method: http.MethodPost, failures: 5, status: http.StatusServiceUnavailable, tries: 1},
+		{name: "body sent again", retry: retry, method: http.MethodPut, body: "payload", failures: 1, status: http.StatusOK, tries: 2},
+		{name: "body too big to retry", retry: retry, method: http.MethodPut, body: "large payload", failures: 1, status: http.StatusServiceUnavailable, tries: 1},
+		{
+			name:     "condition not retried",
+			retry:    models.Retry{Attempts: 2, Backoff: time.Millisecond},
+			method:   http.MethodGet,
+			failures: 5,
+			status:   http.StatusServiceUnavailable,
+			tries:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var tries atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := tries.Add(1)
+				if body, _ := io.ReadAll(r.Body); string(body) != tt.body {
+					t.Errorf("try %d: body = %q; want %q", n, body, tt.body)
+				}
+				if n <= int64(tt.failures) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer srv.Close()
+
+			remote, _ := url.Parse(srv.URL)
+			service := models.Service{Retry: tt.retry}
+			logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+			b := &balancer{
+				upstreams: []*upstream{newUpstream(remote, service, nil, logger)},
+				retry:     newRetryPolicy(tt.retry),
+				logger:    logger,
+			}
+
+			r := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			b.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d; want %d", w.Code, tt.status)
+			}
+			if got := tries.Load(); got != int64(tt.tries) {
+				t.Errorf("tries = %d; want %d", got, tt.tries)
+			}
+		})
+	}
+}
@@ -30,9 +30,13 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodPost, "/admin/api/services/:name/start", app.startService)
 	router.HandlerFunc(http.MethodPost, "/admin/api/services/:name/stop", app.stopService)
+	router.HandlerFunc(http.MethodPost, "/admin/api/services/:name/maintenance", app.enableMaintenance)
+	router.HandlerFunc(http.MethodDelete, "/admin/api/services/:name/maintenance", app.disableMaintenance)
 
 	router.HandlerFunc(http.MethodDelete, "/admin/api/services/:name/env/:key", app.deleteEnvVar)
 
+	router.HandlerFunc(http.MethodPost, "/admin/api/cache/purge", app.purgeCache)
+
 	router.HandlerFunc(http.MethodGet, "/admin/services", app.servicesTableView)
 	router.HandlerFunc(http.MethodGet, "/admin/service/new", app.createServiceFormView)
 	router.HandlerFunc(http.MethodGet, "/admin/services/:name/edit", app.editServiceView)
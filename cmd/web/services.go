@@ -2,13 +2,17 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"net/http"
 
 	"github.com/a-h/templ"
 	"github.com/haidousm/delne/internal/models"
+	"github.com/haidousm/delne/internal/router"
 	"github.com/julienschmidt/httprouter"
 )
 
+const maxReplicas = 16
+
 func (app *application) servicesTableView(w http.ResponseWriter, r *http.Request) {
 	services, err := app.services.GetAll()
 	if err != nil {
@@ -64,7 +68,7 @@ func (app *application) editServiceView(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	image, err := app.images.Get(*service.ImageID)
+	image, err := app.serviceImage(service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -76,10 +80,56 @@ func (app *application) editServiceView(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	component := editServiceForm(*service, *image)
+	app.renderEditServiceForm(w, r, *service, *image)
+}
+
+func (app *application) renderEditServiceForm(w http.ResponseWriter, r *http.Request, service models.Service, image models.Image) {
+	corrections, err := app.corrections.GetForService(service.ID, 10)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	component := editServiceForm(service, image, corrections, app.proxy.RateLimitStats(service), app.proxy.BlockedRequests(service.Name), app.proxy.StreamStats(service.Name))
 	component.Render(r.Context(), w)
 }
 
+// serviceImage returns the image a service runs, or an empty image for services
+// that don't run a container.
+func (app *application) serviceImage(service *models.Service) (*models.Image, error) {
+	if !service.IsContainer() {
+		return &models.Image{}, nil
+	}
+	return app.images.Get(*service.ImageID)
+}
+
+// imageFor finds the image of a service among images, for the services table.
+func imageFor(service *models.Service, images []*models.Image) models.Image {
+	if service.ImageID != nil {
+		for _, image := range images {
+			if image.ID == *service.ImageID {
+				return *image
+			}
+		}
+	}
+	return models.Image{}
+}
+
+// serviceTarget describes where a service's requests end up.
+func serviceTarget(service models.Service, image models.Image) string {
+	switch service.Kind {
+	case models.KIND_EXTERNAL:
+		return service.External.URL
+	case models.KIND_REDIRECT:
+		return fmt.Sprintf("%d -> %s", max(service.Redirect.StatusCode, 301), service.Redirect.URL)
+	case models.KIND_STATIC:
+		return fmt.Sprintf("%d static response", max(service.StaticResponse.StatusCode, 200))
+	case models.KIND_FILES:
+		return service.Files.Root
+	}
+	return image.String()
+}
+
 func (app *application) addEnvVarView(w http.ResponseWriter, r *http.Request) {
 	params := httprouter.ParamsFromContext(r.Context())
 	name := params.ByName("name")
@@ -110,6 +160,17 @@ func (app *application) createService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := router.ValidPattern(host); err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	if kind := models.ServiceKind(r.PostForm.Get("kind")); kind != "" && kind != models.KIND_CONTAINER {
+		// the image field holds the route's target instead
+		app.createRoute(w, r, name, host, kind, image)
+		return
+	}
+
 	imageObj := models.Image{}
 	imageObj.ParseString(image)
 
@@ -126,6 +187,10 @@ func (app *application) createService(w http.ResponseWriter, r *http.Request) {
 		Hosts:   []string{host},
 		Network: &network,
 		Status:  models.PULLING,
+
+		RestartPolicy: models.RESTART_ON_FAILURE,
+		Replicas:      1,
+		LBStrategy:    models.ROUND_ROBIN,
 	}
 
 	app.logger.Debug("creating service", "name", name, "image", image, "host", host)
@@ -149,6 +214,90 @@ func (app *application) createService(w http.ResponseWriter, r *http.Request) {
 	component.Render(r.Context(), w)
 }
 
+// createRoute creates a service that routes its host somewhere other than a
+// container. It starts routing right away.
+func (app *application) createRoute(w http.ResponseWriter, r *http.Request, name, host string, kind models.ServiceKind, target string) {
+	service := models.Service{
+		Name:       name,
+		Hosts:      []string{host},
+		Kind:       kind,
+		Status:     models.RUNNING,
+		Replicas:   1,
+		LBStrategy: models.ROUND_ROBIN,
+	}
+
+	switch kind {
+	case models.KIND_EXTERNAL:
+		if err := validateExternalUrl(target); err != nil {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		service.External = models.ExternalUpstream{URL: target}
+	case models.KIND_REDIRECT:
+		service.Redirect = models.Redirect{URL: target, StatusCode: http.StatusMovedPermanently, PreservePath: true}
+		if err := validateRedirect(service.Redirect); err != nil {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+	case models.KIND_STATIC:
+		service.StaticResponse = models.StaticResponse{StatusCode: http.StatusOK, Body: target}
+	case models.KIND_FILES:
+		if err := validateFileRoot(target); err != nil {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		service.Files = models.FileServer{Root: target}
+	default:
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	app.logger.Debug("creating route", "name", name, "kind", kind, "target", target, "host", host)
+	id, err := app.services.InsertRoute(name, service.Hosts, kind)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	service.ID = id
+
+	err = app.saveRouteConfig(&service)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.proxy.SetService(service)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	app.services.UpdateStatus(id, models.RUNNING)
+
+	onlyPartial := r.Header.Get("HX-Request") == "true"
+	if !onlyPartial {
+		http.Redirect(w, r, "/admin/services", http.StatusSeeOther)
+		return
+	}
+
+	component := servicesTableRow(service, models.Image{})
+	component.Render(r.Context(), w)
+}
+
+// saveRouteConfig stores the settings of the service's kind.
+func (app *application) saveRouteConfig(service *models.Service) error {
+	switch service.Kind {
+	case models.KIND_EXTERNAL:
+		return app.services.UpdateExternal(service.ID, service.External)
+	case models.KIND_REDIRECT:
+		return app.services.UpdateRedirect(service.ID, service.Redirect)
+	case models.KIND_STATIC:
+		return app.services.UpdateStaticResponse(service.ID, service.StaticResponse)
+	case models.KIND_FILES:
+		return app.services.UpdateFiles(service.ID, service.Files)
+	}
+	return nil
+}
+
 func (app *application) deleteService(w http.ResponseWriter, r *http.Request) {
 	params := httprouter.ParamsFromContext(r.Context())
 	name := params.ByName("name")
@@ -164,15 +313,16 @@ func (app *application) deleteService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	app.dClient.RemoveContainer(*service)
-	app.RemoveService(*service)
-
 	err = app.services.Delete(service.ID)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
+	app.proxy.DrainService(service.Name)
+	app.proxy.RemoveService(service.Name)
+	app.dClient.RemoveContainer(*service)
+
 	onlyPartial := r.Header.Get("HX-Request") == "true"
 	if !onlyPartial {
 		http.Redirect(w, r, "/admin/services", http.StatusSeeOther)
@@ -197,12 +347,16 @@ func (app *application) startService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if service.Status == models.RUNNING {
+	if service.IsRunning() {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	err = app.dClient.StartContainer(*service)
+	if service.IsContainer() {
+		err = app.dClient.StartContainer(*service)
+	} else {
+		err = app.proxy.SetService(*service)
+	}
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -217,7 +371,7 @@ func (app *application) startService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := app.images.Get(*service.ImageID)
+	image, err := app.serviceImage(service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -242,19 +396,31 @@ func (app *application) stopService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if service.Status != models.RUNNING {
+	if !service.IsRunning() {
 		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	err = app.dClient.StopContainer(*service)
+	// flip the status first so the container's die event isn't taken for a crash
+	err = app.services.UpdateStatus(service.ID, models.STOPPED)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
+	app.proxy.DrainService(service.Name)
+	if service.IsContainer() {
+		err = app.dClient.StopContainer(*service)
+	} else {
+		// a stopped route stops matching its hosts
+		app.proxy.RemoveService(service.Name)
+	}
+	if err != nil {
+		app.services.UpdateStatus(service.ID, service.Status)
+		app.serverError(w, r, err)
+		return
+	}
 	service.Status = models.STOPPED
-	app.services.UpdateStatus(service.ID, models.STOPPED)
 
 	onlyPartial := r.Header.Get("HX-Request") == "true"
 	if !onlyPartial {
@@ -262,7 +428,7 @@ func (app *application) stopService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := app.images.Get(*service.ImageID)
+	image, err := app.serviceImage(service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -272,16 +438,80 @@ func (app *application) stopService(w http.ResponseWriter, r *http.Request) {
 	component.Render(r.Context(), w)
 }
 
+// setMaintenance switches maintenance mode on or off, the containers keep
+// running either way.
+func (app *application) setMaintenance(w http.ResponseWriter, r *http.Request, enabled bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	name := params.ByName("name")
+
+	if name == "" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	service, err := app.services.GetByName(name)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	service.Maintenance.Enabled = enabled
+	err = app.services.UpdateMaintenance(service.ID, service.Maintenance)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.refreshRoute(service)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	onlyPartial := r.Header.Get("HX-Request") == "true"
+	if !onlyPartial {
+		http.Redirect(w, r, "/admin/services", http.StatusSeeOther)
+		return
+	}
+
+	image, err := app.serviceImage(service)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	component := servicesTableRow(*service, *image)
+	component.Render(r.Context(), w)
+}
+
+func (app *application) enableMaintenance(w http.ResponseWriter, r *http.Request) {
+	app.setMaintenance(w, r, true)
+}
+
+func (app *application) disableMaintenance(w http.ResponseWriter, r *http.Request) {
+	app.setMaintenance(w, r, false)
+}
+
+// refreshRoute re-registers the routes of a service after its settings
+// changed. Stopped services that don't run containers aren't routed at all.
+func (app *application) refreshRoute(service *models.Service) error {
+	if !service.IsContainer() && !service.IsRunning() {
+		return nil
+	}
+	return app.proxy.SetService(*service)
+}
+
 func (app *application) createContainerForService(service *models.Service, image *models.Image) {
 
-	resp, err := app.dClient.CreateContainer(*service, *image)
+	ids, err := app.dClient.CreateContainer(*service, *image)
 
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.services.UpdateStatus(service.ID, models.ERROR)
 		return
 	}
 	app.services.UpdateStatus(service.ID, models.CREATED)
-	app.services.UpdateContainerId(service.ID, resp.ID)
+	app.services.UpdateContainerIds(service.ID, ids)
 
 	service, err = app.services.Get(service.ID)
 	if err != nil {
@@ -289,18 +519,19 @@ func (app *application) createContainerForService(service *models.Service, image
 		return
 	}
 
-	app.logger.Debug("created container", "id", resp.ID)
+	app.logger.Debug("created containers", "ids", ids)
 
 	err = app.dClient.StartContainer(*service)
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.services.UpdateStatus(service.ID, models.ERROR)
 		return
 	}
 	app.services.UpdateStatus(service.ID, models.RUNNING)
 
 	ports := app.dClient.GetContainerPorts(*service)
 	if len(ports) == 0 {
-		app.logger.Error("no ports found for container", "id", resp.ID)
+		app.logger.Error("no ports found for container", "ids", ids)
 		return
 	}
 
@@ -318,9 +549,11 @@ func (app *application) createContainerForService(service *models.Service, image
 		return
 	}
 
-	app.logger.Debug("started container", "id", resp.ID, "port", *service.Port)
-	for _, host := range service.Hosts {
-		app.proxy.Target[host] = service.Name
+	app.logger.Debug("started containers", "ids", ids, "port", *service.Port)
+	err = app.proxy.SetService(*service)
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
 	}
 }
 
@@ -349,53 +582,104 @@ func (app *application) updateService(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	/**
-	 * TODO: currently only supports updating environment variables, make it not just do that lol
-	 */
+	// the whole form is checked before anything is stored, a bad value in
+	// one section must not leave the others applied
+	updated, err := parseServiceForm(r.PostForm, *service)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
 
-	envVars := make(map[string]string)
-	for key, value := range r.PostForm {
-		fmt.Println(key, value[0])
-		if len(key) > 4 && key[:4] == "env-" {
-			envVars[key[4:]] = value[0]
-		} else if key == "new-env-key" {
-			envVars[value[0]] = r.PostForm.Get("new-env-value")
+	if r.PostForm.Has("cache-max-size") {
+		taken, err := app.cacheDirTaken(service, updated.Cache.Dir)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if taken {
+			app.clientError(w, http.StatusBadRequest)
+			return
 		}
 	}
 
-	service.EnvironmentVariables = &envVars
-	err = app.dClient.RemoveContainer(*service)
+	err = app.services.UpdateSettings(&updated)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.services.UpdateStatus(service.ID, models.STOPPED)
+	onlyPartial := r.Header.Get("HX-Request") == "true"
+
+	if !service.IsContainer() || !containerSettingsChanged(*service, updated) {
+		// there is nothing to recreate, the route just picks up the changes
+		err = app.refreshRoute(&updated)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if !onlyPartial {
+			http.Redirect(w, r, "/admin/services", http.StatusSeeOther)
+			return
+		}
+
+		image := models.Image{}
+		if updated.IsContainer() {
+			i, err := app.serviceImage(&updated)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+			image = *i
+		}
+		app.renderEditServiceForm(w, r, updated, image)
+		return
+	}
+
+	err = app.services.UpdateStatus(updated.ID, models.STOPPED)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
-	err = app.services.UpdateEnvironmentVariables(service.ID, envVars)
+
+	app.proxy.DrainService(updated.Name)
+	err = app.dClient.RemoveContainer(*service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	image, err := app.images.Get(*service.ImageID)
+	image, err := app.serviceImage(&updated)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	go app.createContainerForService(service, image)
-	onlyPartial := r.Header.Get("HX-Request") == "true"
+	go app.createContainerForService(&updated, image)
 	if !onlyPartial {
 		http.Redirect(w, r, "/admin/services", http.StatusSeeOther)
 		return
 	}
 
-	component := editServiceForm(*service, *image)
-	component.Render(r.Context(), w)
+	app.renderEditServiceForm(w, r, updated, *image)
+}
+
+// containerSettingsChanged reports whether the service's containers have to
+// be recreated for an update to take effect. Everything else is proxy
+// settings, which only need the route rebuilt.
+func containerSettingsChanged(old, updated models.Service) bool {
+	return !sameImage(old.ImageID, updated.ImageID) ||
+		old.RestartPolicy != updated.RestartPolicy ||
+		old.Replicas != updated.Replicas ||
+		!maps.Equal(*old.EnvironmentVariables, *updated.EnvironmentVariables)
+}
+
+// sameImage compares two image ids by value, either of which may be unset.
+func sameImage(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
 }
 
 func (app *application) deleteEnvVar(w http.ResponseWriter, r *http.Request) {
@@ -425,16 +709,22 @@ func (app *application) deleteEnvVar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !service.IsContainer() {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
 	envVars := *service.EnvironmentVariables
 	delete(envVars, key)
 
-	err = app.dClient.RemoveContainer(*service)
+	err = app.services.UpdateStatus(service.ID, models.STOPPED)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.services.UpdateStatus(service.ID, models.STOPPED)
+	app.proxy.DrainService(service.Name)
+	err = app.dClient.RemoveContainer(*service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -446,7 +736,7 @@ func (app *application) deleteEnvVar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	image, err := app.images.Get(*service.ImageID)
+	image, err := app.serviceImage(service)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -459,6 +749,5 @@ func (app *application) deleteEnvVar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	component := editServiceForm(*service, *image)
-	component.Render(r.Context(), w)
+	app.renderEditServiceForm(w, r, *service, *image)
 }
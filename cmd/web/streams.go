@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+const (
+	defaultDrainTimeout = 10 * time.Second
+
+	// drainSignalTimeout bounds how long a drain waits for the clients of a
+	// service's streams to be told to go away, before the service's
+	// upstreams are taken down
+	drainSignalTimeout = time.Second
+
+	// controlWriteTimeout bounds writing a ping or close frame, so a client
+	// that stopped reading can't hold up the connection's keepalive.
+	controlWriteTimeout = 5 * time.Second
+)
+
+var (
+	wsPingFrame = []byte{0x89, 0x00}
+	// a close frame with status 1001, going away
+	wsGoingAwayFrame = []byte{0x88, 0x02, 0x03, 0xe9}
+
+	// lines starting with a colon are comments, which EventSource ignores
+	sseComment = []byte(": ping\n\n")
+)
+
+// stream is a long-lived connection of a service, an upgraded connection
+// like a WebSocket or an event stream.
+type stream interface {
+	// lastActive is when something was last sent over the stream, not
+	// counting pings.
+	lastActive() time.Time
+	// ping sends the client something to keep the stream open and reports
+	// whether it could.
+	ping() bool
+	// drain asks the client to close the stream, so it reconnects to the
+	// service once it is back.
+	drain()
+	close()
+}
+
+// streamTracker keeps track of the open streams of a service. It outlives the
+// service's routes, so streams opened before a redeploy can be drained.
+type streamTracker struct {
+	mu           sync.Mutex
+	streams      map[stream]struct{}
+	drainTimeout time.Duration
+
+	draining atomic.Int32 // drains still waiting for their streams
+}
+
+// streamStats describes the streams of a service for the dashboard.
+type streamStats struct {
+	Open     int
+	Draining bool
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{streams: map[stream]struct{}{}, drainTimeout: defaultDrainTimeout}
+}
+
+func (t *streamTracker) setDrainTimeout(d time.Duration) {
+	if d <= 0 {
+		d = defaultDrainTimeout
+	}
+	t.mu.Lock()
+	t.drainTimeout = d
+	t.mu.Unlock()
+}
+
+func (t *streamTracker) add(s stream) {
+	t.mu.Lock()
+	t.streams[s] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *streamTracker) remove(s stream) {
+	t.mu.Lock()
+	delete(t.streams, s)
+	t.mu.Unlock()
+}
+
+func (t *streamTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
+
+func (t *streamTracker) open() []stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	streams := make([]stream, 0, len(t.streams))
+	for s := range t.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// drain asks every open stream to close, waiting at most drainSignalTimeout
+// for the clients to be told. The streams then get the drain timeout to
+// close in the background, the ones still open after it are cut. Streams
+// opened in the meantime, e.g. by clients reconnecting, are left alone.
+func (t *streamTracker) drain(logger *slog.Logger) {
+	streams := t.open()
+	if len(streams) == 0 {
+		return
+	}
+	logger.Info("draining streams", "open", len(streams))
+
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s stream) {
+			defer wg.Done()
+			s.drain()
+		}(s)
+	}
+	signaled := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(signaled)
+	}()
+	select {
+	case <-signaled:
+	case <-time.After(drainSignalTimeout):
+	}
+
+	t.mu.Lock()
+	deadline := time.Now().Add(t.drainTimeout)
+	t.mu.Unlock()
+
+	t.draining.Add(1)
+	go func() {
+		defer t.draining.Add(-1)
+
+		for len(t.stillOpen(streams)) > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		cut := t.stillOpen(streams)
+		for _, s := range cut {
+			s.close()
+		}
+		logger.Info("drained streams", "closed", len(streams)-len(cut), "cut", len(cut))
+	}()
+}
+
+// stillOpen returns the streams out of streams that are still open.
+func (t *streamTracker) stillOpen(streams []stream) []stream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	open := []stream{}
+	for _, s := range streams {
+		if _, ok := t.streams[s]; ok {
+			open = append(open, s)
+		}
+	}
+	return open
+}
+
+func (t *streamTracker) stats() streamStats {
+	return streamStats{Open: t.active(), Draining: t.draining.Load() > 0}
+}
+
+// keepAlive pings a stream once it has been quiet for the ping interval and
+// closes it once it has been idle for the idle timeout, until stop is closed.
+func keepAlive(s stream, ping, idle time.Duration, stop <-chan struct{}) {
+	tick := min(ping, idle)
+	if ping <= 0 || idle <= 0 {
+		tick = max(ping, idle)
+	}
+	if tick <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tick / 2)
+	defer ticker.Stop()
+
+	var lastPing time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			active := s.lastActive()
+			if idle > 0 && now.Sub(active) >= idle {
+				s.close()
+				return
+			}
+			if ping > 0 && now.Sub(active) >= ping && now.Sub(lastPing) >= ping && s.ping() {
+				lastPing = now
+			}
+		}
+	}
+}
+
+// streamHandler tracks the streams of a service's requests and keeps the
+// server's timeouts from cutting them.
+type streamHandler struct {
+	next    http.Handler
+	tracker *streamTracker
+	ping    time.Duration
+	idle    time.Duration
+
+	// keepDeadlines leaves the deadlines of event streams alone, as the
+	// service has a total timeout of its own
+	keepDeadlines bool
+}
+
+func withStreams(next http.Handler, tracker *streamTracker, cfg models.Streaming, timeouts models.Timeouts) http.Handler {
+	return &streamHandler{
+		next:          next,
+		tracker:       tracker,
+		ping:          cfg.PingInterval,
+		idle:          cfg.IdleTimeout,
+		keepDeadlines: timeouts.Total > 0,
+	}
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	sw := &streamWriter{
+		ResponseWriter: w,
+		h:              h,
+		cancel:         cancel,
+		websocket:      strings.EqualFold(r.Header.Get("Upgrade"), "websocket"),
+	}
+	defer sw.finish()
+	h.next.ServeHTTP(sw, r.WithContext(ctx))
+}
+
+// streamWriter notices responses that are event streams and hands out the
+// connection of upgraded requests as a tunnel.
+type streamWriter struct {
+	http.ResponseWriter
+	h         *streamHandler
+	cancel    context.CancelFunc // ends the request, and with it the stream
+	websocket bool
+
+	// mu serializes the writes of the handler with pings
+	mu          sync.Mutex
+	wroteHeader bool
+	events      bool
+	done        bool
+	tail        []byte // the last bytes written, to find the end of an event
+	lastWrite   time.Time
+	stop        chan struct{}
+}
+
+func (sw *streamWriter) WriteHeader(code int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.writeHeader(code)
+}
+
+// writeHeader is WriteHeader for callers holding sw.mu.
+func (sw *streamWriter) writeHeader(code int) {
+	if sw.wroteHeader || sw.done {
+		return
+	}
+	if code < http.StatusOK {
+		sw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	sw.wroteHeader = true
+
+	mediaType, _, _ := mime.ParseMediaType(sw.Header().Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		sw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	sw.events = true
+	sw.lastWrite = time.Now()
+	rc := http.NewResponseController(sw.ResponseWriter)
+	if !sw.h.keepDeadlines {
+		// the stream stays open for as long as the client listens
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	sw.ResponseWriter.WriteHeader(code)
+	rc.Flush()
+
+	sw.h.tracker.add(sw)
+	sw.stop = make(chan struct{})
+	go keepAlive(sw, sw.h.ping, sw.h.idle, sw.stop)
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if !sw.wroteHeader {
+		sw.writeHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	if sw.events && n > 0 {
+		sw.lastWrite = time.Now()
+		sw.tail = append(sw.tail, p[:n]...)
+		sw.tail = sw.tail[max(len(sw.tail)-4, 0):]
+		// events are passed on the moment they arrive
+		http.NewResponseController(sw.ResponseWriter).Flush()
+	}
+	return n, err
+}
+
+func (sw *streamWriter) Flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.done {
+		http.NewResponseController(sw.ResponseWriter).Flush()
+	}
+}
+
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// Hijack hands out the client connection of an upgraded request wrapped in a
+// tunnel.
+func (sw *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the server's read and write timeouts must not cut the tunnel, hijacking
+	// is meant to clear them but we don't rely on it
+	conn.SetDeadline(time.Time{})
+	return newTunnel(conn, sw.websocket, sw.h), brw, nil
+}
+
+func (sw *streamWriter) lastActive() time.Time {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.lastWrite
+}
+
+// ping sends a comment between two events.
+func (sw *streamWriter) ping() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.done || !endsEvent(sw.tail) {
+		return false
+	}
+	if _, err := sw.ResponseWriter.Write(sseComment); err != nil {
+		return false
+	}
+	return http.NewResponseController(sw.ResponseWriter).Flush() == nil
+}
+
+// drain ends the response, EventSource clients reconnect on their own.
+func (sw *streamWriter) drain() {
+	sw.cancel()
+}
+
+func (sw *streamWriter) close() {
+	sw.cancel()
+}
+
+// finish stops tracking the response once the handler returns.
+func (sw *streamWriter) finish() {
+	sw.mu.Lock()
+	sw.done = true
+	events := sw.events
+	sw.mu.Unlock()
+
+	if events {
+		close(sw.stop)
+		sw.h.tracker.remove(sw)
+	}
+}
+
+// endsEvent reports whether an event stream ending in tail is between two
+// events, or hasn't sent one yet.
+func endsEvent(tail []byte) bool {
+	s := string(tail)
+	return s == "" || strings.HasSuffix(s, "\n\n") || strings.HasSuffix(s, "\r\r") || strings.HasSuffix(s, "\r\n\r\n")
+}
+
+// tunnel is the client side of an upgraded connection. It follows the frames
+// the upstream sends over a WebSocket, so pings and close frames can be
+// slipped in between them.
+type tunnel struct {
+	net.Conn
+	tracker   *streamTracker
+	websocket bool
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	active atomic.Int64 // unix nanoseconds of the last read or write
+
+	// mu serializes writes to the client
+	mu       sync.Mutex
+	frames   wsFrames
+	draining bool
+	closing  bool // a close frame was sent
+}
+
+func newTunnel(conn net.Conn, websocket bool, h *streamHandler) *tunnel {
+	t := &tunnel{Conn: conn, tracker: h.tracker, websocket: websocket, stop: make(chan struct{})}
+	t.active.Store(time.Now().UnixNano())
+	t.tracker.add(t)
+	go keepAlive(t, h.ping, h.idle, t.stop)
+	return t
+}
+
+func (t *tunnel) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.active.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (t *tunnel) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, err := t.Conn.Write(p)
+	if n > 0 {
+		t.active.Store(time.Now().UnixNano())
+		if t.websocket {
+			t.frames.advance(p[:n])
+		}
+	}
+	if err == nil && t.draining && !t.closing {
+		t.sendClose()
+	}
+	return n, err
+}
+
+// CloseWrite passes on that the upstream is done sending, if the client
+// connection supports half-closing.
+func (t *tunnel) CloseWrite() error {
+	if cw, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection can't be half-closed")
+}
+
+func (t *tunnel) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		t.tracker.remove(t)
+	})
+	return t.Conn.Close()
+}
+
+func (t *tunnel) lastActive() time.Time {
+	return time.Unix(0, t.active.Load())
+}
+
+func (t *tunnel) ping() bool {
+	if !t.websocket {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.closing && t.writeControl(wsPingFrame)
+}
+
+// drain sends a WebSocket client a close frame, going away, as soon as the
+// upstream is between frames. Other protocols are left to be cut.
+func (t *tunnel) drain() {
+	if !t.websocket {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	if !t.closing {
+		t.sendClose()
+	}
+}
+
+func (t *tunnel) close() {
+	t.Close()
+}
+
+// sendClose is called with t.mu held.
+func (t *tunnel) sendClose() {
+	t.closing = t.writeControl(wsGoingAwayFrame)
+}
+
+// writeControl writes a control frame if the upstream is between frames.
+// Callers hold t.mu.
+func (t *tunnel) writeControl(frame []byte) bool {
+	if !t.frames.atBoundary() {
+		return false
+	}
+
+	t.Conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
+	_, err := t.Conn.Write(frame)
+	t.Conn.SetWriteDeadline(time.Time{})
+	return err == nil
+}
+
+// wsFrames follows a stream of WebSocket frames, to know when it is between
+// two of them.
+type wsFrames struct {
+	header    []byte // of the frame being read, until it is complete
+	remaining uint64 // payload bytes left of the current frame
+}
+
+func (f *wsFrames) atBoundary() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+func (f *wsFrames) advance(p []byte) {
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := min(uint64(len(p)), f.remaining)
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+		if size := wsHeaderSize(f.header); size > 0 && len(f.header) == size {
+			f.remaining = wsPayloadLength(f.header)
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// wsHeaderSize returns the size of the frame header that starts with h, or 0
+// if h is too short to tell.
+func wsHeaderSize(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	return size
+}
+
+func wsPayloadLength(h []byte) uint64 {
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(n)
+	}
+}
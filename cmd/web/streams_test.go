@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStream ignores being drained, or closes on it when polite.
+type fakeStream struct {
+	tracker *streamTracker
+	polite  bool
+	closed  atomic.Bool
+}
+
+func (s *fakeStream) lastActive() time.Time { return time.Now() }
+func (s *fakeStream) ping() bool            { return true }
+
+func (s *fakeStream) drain() {
+	if s.polite {
+		s.close()
+	}
+}
+
+func (s *fakeStream) close() {
+	s.closed.Store(true)
+	s.tracker.remove(s)
+}
+
+func TestStreamTrackerDrain(t *testing.T) {
+	tracker := newStreamTracker()
+	tracker.setDrainTimeout(300 * time.Millisecond)
+
+	polite := &fakeStream{tracker: tracker, polite: true}
+	stubborn := &fakeStream{tracker: tracker}
+	tracker.add(polite)
+	tracker.add(stubborn)
+
+	start := time.Now()
+	tracker.drain(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if d := time.Since(start); d > drainSignalTimeout {
+		t.Fatalf("drain blocked for %v", d)
+	}
+
+	// a client reconnecting during the drain is not cut
+	reconnected := &fakeStream{tracker: tracker}
+	tracker.add(reconnected)
+
+	if got := tracker.stats(); got.Open != 2 || !got.Draining {
+		t.Errorf("stats while draining = %+v; want 2 open, draining", got)
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	if !polite.closed.Load() || !stubborn.closed.Load() {
+		t.Errorf("closed = %v, %v; want both drained streams closed", polite.closed.Load(), stubborn.closed.Load())
+	}
+	if reconnected.closed.Load() {
+		t.Error("stream opened during the drain was cut")
+	}
+	if got := tracker.stats(); got.Open != 1 || got.Draining {
+		t.Errorf("stats after draining = %+v; want 1 open, not draining", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/haidousm/delne/internal/models"
+)
+
+// deadlineGrace leaves time to tell the client a request ran out of time
+// before the server cuts the connection.
+const deadlineGrace = time.Second
+
+// upstreamTimeouts reports whether any of the timeouts apply to the
+// connections to upstreams, which need a transport of their own.
+func upstreamTimeouts(t models.Timeouts) bool {
+	return t.Dial > 0 || t.ResponseHeader > 0 || t.Idle > 0
+}
+
+// timeoutTransport returns a copy of http.DefaultTransport with the service's
+// upstream timeouts.
+func timeoutTransport(t models.Timeouts) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t.Dial > 0 {
+		dialer := &net.Dialer{Timeout: t.Dial, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if t.ResponseHeader > 0 {
+		transport.ResponseHeaderTimeout = t.ResponseHeader
+	}
+	if t.Idle > 0 {
+		transport.IdleConnTimeout = t.Idle
+	}
+	return transport
+}
+
+// timeoutHandler replaces the server's read and write timeouts for a
+// service's requests and limits the size of their bodies.
+type timeoutHandler struct {
+	next        http.Handler
+	total       time.Duration
+	longLived   bool
+	maxBodySize int64
+}
+
+// withTimeouts wraps next if the service changes any of the client side
+// limits.
+func withTimeouts(next http.Handler, t models.Timeouts) http.Handler {
+	if t.Total <= 0 && !t.LongLived && t.MaxBodySize <= 0 {
+		return next
+	}
+	return &timeoutHandler{next: next, total: t.Total, longLived: t.LongLived, maxBodySize: t.MaxBodySize}
+}
+
+func (h *timeoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.maxBodySize > 0 {
+		if r.ContentLength > h.maxBodySize {
+			renderProxyError(w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// bodies without a length are cut off once they get too big, which
+		// the upstream's error handler turns into a 413
+		r.Body = http.MaxBytesReader(w, r.Body, h.maxBodySize)
+	}
+
+	// the deadlines only fail to move on connections that don't support
+	// them, which then keep the server's
+	rc := http.NewResponseController(w)
+	switch {
+	case h.total > 0:
+		deadline := time.Now().Add(h.total)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline.Add(deadlineGrace))
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(ctx)
+	case h.longLived:
+		// the zero time means no deadline
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+
+	h.next.ServeHTTP(w, r)
+}
@@ -103,15 +103,18 @@ func (c *Client) createNetwork(name string) error {
 	return nil
 }
 
-func (c *Client) CreateContainer(service models.Service, image models.Image) (container.CreateResponse, error) {
+// CreateContainer creates one container per replica of the service and
+// returns their ids in replica order. Nothing is left behind if any of them
+// fails to be created.
+func (c *Client) CreateContainer(service models.Service, image models.Image) ([]string, error) {
 
-	c.logger.Debug("creating container", "service", service.Name, "image", image.String())
+	c.logger.Debug("creating containers", "service", service.Name, "image", image.String(), "replicas", service.Replicas)
 	if err := c.pullImage(image); err != nil {
-		return container.CreateResponse{}, err
+		return nil, err
 	}
 	c.logger.Debug("image pulled", "service", service.Name, "image", image.String())
 	if err := c.createNetwork(*service.Network); err != nil {
-		return container.CreateResponse{}, err
+		return nil, err
 	}
 	c.logger.Debug("network created", "service", service.Name, "network", *service.Network)
 
@@ -130,44 +133,63 @@ func (c *Client) CreateContainer(service models.Service, image models.Image) (co
 		config.Env = env
 	}
 
-	resp, err := c.client.ContainerCreate(context.Background(), config, hostConfig, nil, nil, service.Name)
-	c.logger.Debug("container created", "service", service.Name, "container", resp.ID)
-	if err != nil {
-		return container.CreateResponse{}, err
+	replicas := max(service.Replicas, 1)
+	ids := []string{}
+	for i := 0; i < replicas; i++ {
+		resp, err := c.client.ContainerCreate(context.Background(), config, hostConfig, nil, nil, service.ReplicaName(i))
+		if err != nil {
+			for _, id := range ids {
+				c.RemoveContainerById(id)
+			}
+			return nil, err
+		}
+		c.logger.Debug("container created", "service", service.Name, "replica", i, "container", resp.ID)
+		ids = append(ids, resp.ID)
 	}
-	return resp, nil
+	return ids, nil
 }
 
+// StartContainer starts the containers of all of the service's replicas.
 func (c *Client) StartContainer(service models.Service) error {
-	if service.ContainerId == nil {
+	if len(service.ContainerIds) == 0 {
 		return errors.New("container id is empty")
 	}
 
-	err := c.client.ContainerStart(context.Background(), *service.ContainerId, types.ContainerStartOptions{})
+	var errs []error
+	for _, id := range service.ContainerIds {
+		errs = append(errs, c.StartContainerById(id))
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Client) StartContainerById(id string) error {
+	err := c.client.ContainerStart(context.Background(), id, types.ContainerStartOptions{})
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// StopContainer stops the containers of all of the service's replicas.
 func (c *Client) StopContainer(service models.Service) error {
-	if service.ContainerId == nil {
+	if len(service.ContainerIds) == 0 {
 		return errors.New("container id is empty")
 	}
 
-	err := c.client.ContainerStop(context.Background(), *service.ContainerId, container.StopOptions{})
-	if err != nil {
-		return err
+	var errs []error
+	for _, id := range service.ContainerIds {
+		errs = append(errs, c.client.ContainerStop(context.Background(), id, container.StopOptions{}))
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
+// RemoveContainer removes the containers of all of the service's replicas.
 func (c *Client) RemoveContainer(service models.Service) error {
-	if service.ContainerId == nil {
-		return nil
+	var errs []error
+	for _, id := range service.ContainerIds {
+		errs = append(errs, c.RemoveContainerById(id))
 	}
-
-	return c.RemoveContainerById(*service.ContainerId)
+	return errors.Join(errs...)
 }
 
 func (c *Client) RemoveContainerById(id string) error {
@@ -178,18 +200,30 @@ func (c *Client) RemoveContainerById(id string) error {
 	return nil
 }
 
+// inspectContainer inspects the first replica of the service, which is
+// configured the same as all the others.
 func (c *Client) inspectContainer(service models.Service) (types.ContainerJSON, error) {
-	if service.ContainerId == nil {
-		return types.ContainerJSON{}, nil
+	if len(service.ContainerIds) == 0 {
+		return types.ContainerJSON{}, errors.New("container id is empty")
 	}
 
-	resp, err := c.client.ContainerInspect(context.Background(), *service.ContainerId)
+	resp, err := c.client.ContainerInspect(context.Background(), service.ContainerIds[0])
 	if err != nil {
 		return types.ContainerJSON{}, err
 	}
 	return resp, nil
 }
 
+// GetContainerState returns the state of a container, including the exit code
+// of its last run.
+func (c *Client) GetContainerState(id string) (*types.ContainerState, error) {
+	resp, err := c.client.ContainerInspect(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	return resp.State, nil
+}
+
 func (c *Client) GetContainerPorts(service models.Service) []string {
 	ports := []string{}
 	resp, err := c.inspectContainer(service)
@@ -217,7 +251,8 @@ func (c *Client) GetContainerEnv(service models.Service) map[string]string {
 	return env
 }
 
+// ListContainers lists all containers, including stopped ones.
 func (c *Client) ListContainers() ([]types.Container, error) {
-	containers, err := c.client.ContainerList(context.Background(), types.ContainerListOptions{})
+	containers, err := c.client.ContainerList(context.Background(), types.ContainerListOptions{All: true})
 	return containers, err
 }
@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+type ContainerAction string
+
+const (
+	START         ContainerAction = "start"
+	DIE           ContainerAction = "die"
+	OOM           ContainerAction = "oom"
+	HEALTH_STATUS ContainerAction = "health_status"
+	DESTROY       ContainerAction = "destroy"
+)
+
+// ContainerEvent is a lifecycle event of a single container.
+type ContainerEvent struct {
+	ContainerID string
+	Action      ContainerAction
+
+	// ExitCode is only set for die events.
+	ExitCode int
+	// Health is "healthy" or "unhealthy", only set for health_status events.
+	Health string
+}
+
+const eventsRetryDelay = time.Second
+
+// WatchContainerEvents calls handle for every container lifecycle event until
+// ctx is cancelled. The stream is resubscribed whenever it breaks, events that
+// happen in between are lost.
+func (c *Client) WatchContainerEvents(ctx context.Context, handle func(ContainerEvent)) {
+	args := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for _, action := range []ContainerAction{START, DIE, OOM, HEALTH_STATUS, DESTROY} {
+		args.Add("event", string(action))
+	}
+
+	for {
+		messages, errs := c.client.Events(ctx, types.EventsOptions{Filters: args})
+
+	stream:
+		for {
+			select {
+			case msg := <-messages:
+				if event, ok := parseContainerEvent(msg); ok {
+					handle(event)
+				}
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				c.logger.Error("docker events stream broke", "error", err.Error())
+				break stream
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventsRetryDelay):
+		}
+	}
+}
+
+func parseContainerEvent(msg events.Message) (ContainerEvent, bool) {
+	action, detail, _ := strings.Cut(msg.Action, ":")
+	event := ContainerEvent{
+		ContainerID: msg.Actor.ID,
+		Action:      ContainerAction(action),
+	}
+
+	switch event.Action {
+	case DIE:
+		event.ExitCode, _ = strconv.Atoi(msg.Actor.Attributes["exitCode"])
+	case HEALTH_STATUS:
+		event.Health = strings.TrimSpace(detail)
+	case START, OOM, DESTROY:
+	default:
+		return ContainerEvent{}, false
+	}
+
+	return event, event.ContainerID != ""
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type CorrectionAction string
+
+const (
+	RECREATED         CorrectionAction = "RECREATED"
+	RESTARTED         CorrectionAction = "RESTARTED"
+	STOPPED_CONTAINER CorrectionAction = "STOPPED_CONTAINER"
+	MARKED_STATUS     CorrectionAction = "MARKED_STATUS"
+)
+
+// Correction records a change the reconciler made to bring a service back to
+// its desired state.
+type Correction struct {
+	ID          int
+	ServiceID   int
+	ServiceName string
+	Action      CorrectionAction
+	Reason      string
+
+	Created time.Time
+}
+
+type CorrectionModelInterface interface {
+	Insert(serviceId int, serviceName string, action CorrectionAction, reason string) (int, error)
+	GetForService(serviceId int, limit int) ([]*Correction, error)
+}
+
+type CorrectionModel struct {
+	DB *sql.DB
+}
+
+func (m *CorrectionModel) Insert(serviceId int, serviceName string, action CorrectionAction, reason string) (int, error) {
+	stmt := `INSERT INTO corrections (service_id, service_name, action, reason, created) VALUES ($1, $2, $3, $4, datetime('now')) RETURNING id`
+	var id int
+	err := m.DB.QueryRow(stmt, serviceId, serviceName, action, reason).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *CorrectionModel) GetForService(serviceId int, limit int) ([]*Correction, error) {
+	stmt := `SELECT id, service_id, service_name, action, reason, created FROM corrections WHERE service_id = $1 ORDER BY id DESC LIMIT $2`
+	rows, err := m.DB.Query(stmt, serviceId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var corrections []*Correction
+	for rows.Next() {
+		var c Correction
+		err := rows.Scan(&c.ID, &c.ServiceID, &c.ServiceName, &c.Action, &c.Reason, &c.Created)
+		if err != nil {
+			return nil, err
+		}
+		corrections = append(corrections, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return corrections, nil
+}
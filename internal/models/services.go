@@ -16,43 +16,538 @@ const (
 	RUNNING ServiceStatus = "RUNNING"
 	STOPPED ServiceStatus = "STOPPED"
 	ERROR   ServiceStatus = "ERROR"
+	// DEGRADED services are running, but some of their replicas fail their
+	// health checks and are not getting any traffic.
+	DEGRADED ServiceStatus = "DEGRADED"
 )
 
+// RestartPolicy decides what the reconciler does when a service's container
+// exits while the service is supposed to be running.
+type RestartPolicy string
+
+const (
+	RESTART_ALWAYS     RestartPolicy = "always"
+	RESTART_ON_FAILURE RestartPolicy = "on-failure"
+	RESTART_NEVER      RestartPolicy = "never"
+)
+
+func (p RestartPolicy) Valid() bool {
+	switch p {
+	case RESTART_ALWAYS, RESTART_ON_FAILURE, RESTART_NEVER:
+		return true
+	}
+	return false
+}
+
+// LBStrategy decides which replica of a service gets a request.
+type LBStrategy string
+
+const (
+	ROUND_ROBIN       LBStrategy = "round-robin"
+	LEAST_CONNECTIONS LBStrategy = "least-connections"
+	RANDOM            LBStrategy = "random"
+	IP_HASH           LBStrategy = "ip-hash"
+)
+
+func (s LBStrategy) Valid() bool {
+	switch s {
+	case ROUND_ROBIN, LEAST_CONNECTIONS, RANDOM, IP_HASH:
+		return true
+	}
+	return false
+}
+
+// HealthCheck configures how the proxy probes each replica of a service. It is
+// disabled when Path is empty.
+type HealthCheck struct {
+	Path           string
+	ExpectedStatus int // any 2xx or 3xx when 0
+	Interval       time.Duration
+	Timeout        time.Duration
+
+	// HealthyThreshold consecutive successes bring an ejected replica back,
+	// UnhealthyThreshold consecutive failures eject it.
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+func (h HealthCheck) Enabled() bool {
+	return h.Path != ""
+}
+
+// CircuitBreaker configures when the proxy stops sending requests to a replica
+// that keeps failing. It is disabled when FailureThreshold is 0.
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+}
+
+func (c CircuitBreaker) Enabled() bool {
+	return c.FailureThreshold > 0
+}
+
+// HeaderTarget is which side of the proxy a header rule rewrites.
+type HeaderTarget string
+
+const (
+	HEADER_REQUEST  HeaderTarget = "request"  // sent upstream
+	HEADER_RESPONSE HeaderTarget = "response" // sent to the client
+)
+
+type HeaderAction string
+
+const (
+	HEADER_SET    HeaderAction = "set"
+	HEADER_APPEND HeaderAction = "append"
+	HEADER_REMOVE HeaderAction = "remove"
+)
+
+// HeaderRule rewrites a single header. Value may reference {client_ip},
+// {request_id}, {host} and whatever a wildcard or regex host captured, e.g.
+// {label}, which are filled in per request.
+type HeaderRule struct {
+	Target HeaderTarget
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// PathMode decides what happens to the path prefix a route matched on before
+// the request is proxied.
+type PathMode string
+
+const (
+	PATH_STRIP    PathMode = "strip"
+	PATH_PRESERVE PathMode = "preserve"
+	PATH_REWRITE  PathMode = "rewrite" // replace it with PathRewrite.Prefix
+)
+
+func (m PathMode) Valid() bool {
+	switch m {
+	case PATH_STRIP, PATH_PRESERVE, PATH_REWRITE:
+		return true
+	}
+	return false
+}
+
+// PathRewrite configures how request paths are mapped onto the upstream. The
+// zero value strips the matched prefix.
+type PathRewrite struct {
+	Mode   PathMode
+	Prefix string
+
+	// Regex rewrites run in order on the path once the prefix was handled.
+	Regex []RegexRewrite
+}
+
+// RegexRewrite replaces matches of Pattern with Replacement, which may refer
+// to capture groups as $1.
+type RegexRewrite struct {
+	Pattern     string
+	Replacement string
+}
+
+// ServiceKind is what a service routes its hosts to.
+type ServiceKind string
+
+const (
+	KIND_CONTAINER ServiceKind = "container"
+	// KIND_EXTERNAL services proxy to a URL delne doesn't manage, like another
+	// machine or a process on the host.
+	KIND_EXTERNAL ServiceKind = "external"
+	// KIND_REDIRECT and KIND_STATIC services answer requests from the proxy
+	// itself.
+	KIND_REDIRECT ServiceKind = "redirect"
+	KIND_STATIC   ServiceKind = "static"
+	// KIND_FILES services serve files from a directory on the host.
+	KIND_FILES ServiceKind = "files"
+)
+
+// ExternalUpstream is where an external service proxies to.
+type ExternalUpstream struct {
+	URL string
+
+	// InsecureSkipVerify disables certificate checks for https upstreams,
+	// ServerName overrides the SNI and the name the certificate is checked
+	// against, and CAFile trusts an extra PEM encoded CA.
+	InsecureSkipVerify bool
+	ServerName         string
+	CAFile             string
+
+	// PreserveHost passes the client's Host header on instead of the
+	// upstream's.
+	PreserveHost bool
+}
+
+// Redirect sends clients elsewhere.
+type Redirect struct {
+	URL        string
+	StatusCode int // 301 when 0
+
+	// PreservePath appends the request's path and query to URL.
+	PreservePath bool
+}
+
+// StaticResponse is a fixed response, e.g. a "we'll be back" page.
+type StaticResponse struct {
+	StatusCode  int    // 200 when 0
+	ContentType string // text/plain when empty
+	Body        string
+}
+
+// FileServer serves the files under Root.
+type FileServer struct {
+	Root string
+
+	// SPA serves Root/index.html for paths that don't exist, Listing lists
+	// directories without an index.html.
+	SPA     bool
+	Listing bool
+
+	// MaxAge is how long clients may cache files, HTML is always revalidated.
+	MaxAge time.Duration
+
+	// Precompressed serves file.br or file.gz instead of file when they
+	// exist and the client accepts them.
+	Precompressed bool
+}
+
+// Maintenance makes the proxy answer with a maintenance page instead of
+// routing to the service, without stopping it.
+type Maintenance struct {
+	Enabled bool
+
+	Page       string        // HTML, a default page is shown when empty
+	RetryAfter time.Duration // hint for clients, 5 minutes when 0
+
+	// AllowIPs are addresses or CIDR ranges that still reach the service, as
+	// do clients sending the BypassToken in a cookie.
+	AllowIPs    []string
+	BypassToken string
+}
+
+// RateLimitKey is what requests are counted by.
+type RateLimitKey string
+
+const (
+	RATE_LIMIT_IP     RateLimitKey = "ip"
+	RATE_LIMIT_HEADER RateLimitKey = "header"
+	RATE_LIMIT_GLOBAL RateLimitKey = "global"
+)
+
+// RateLimit is a token bucket per client IP, per value of a header (e.g. an
+// API key) or shared by every request.
+type RateLimit struct {
+	Key    RateLimitKey
+	Header string // for RATE_LIMIT_HEADER
+
+	// Requests are allowed Per duration on average, in bursts of up to Burst
+	// requests (Requests when 0).
+	Requests int
+	Per      time.Duration
+	Burst    int
+
+	// Host limits the rate limit to one of the service's hosts, it applies
+	// to all of them when empty.
+	Host string
+}
+
+type AccessAction string
+
+const (
+	ACCESS_ALLOW AccessAction = "allow"
+	ACCESS_DENY  AccessAction = "deny"
+)
+
+// AccessRule allows or denies client addresses and CIDR ranges. Denied
+// clients are always blocked, and once a host has allow rules only the
+// clients they match get through.
+type AccessRule struct {
+	Action AccessAction
+	Ranges []string
+
+	// Host limits the rule to one of the service's hosts, it applies to all
+	// of them when empty.
+	Host string
+}
+
+type AuthMode string
+
+const (
+	AUTH_NONE    AuthMode = ""
+	AUTH_BASIC   AuthMode = "basic"
+	AUTH_FORWARD AuthMode = "forward"
+)
+
+// BasicAuthUser is a user allowed through basic auth, PasswordHash is a
+// bcrypt hash.
+type BasicAuthUser struct {
+	Username     string
+	PasswordHash string
+}
+
+// AuthGate makes clients authenticate before they reach the service, with
+// basic auth or by asking an auth service (forward auth).
+type AuthGate struct {
+	Mode AuthMode
+
+	Realm string
+	Users []BasicAuthUser
+
+	// ForwardURL is called with the client's headers for every request, a 2xx
+	// lets the request through with the auth service's ForwardHeaders copied
+	// onto it, anything else is sent back to the client.
+	ForwardURL     string
+	ForwardHeaders []string
+
+	// Hosts limits the gate to some of the service's hosts, it protects all
+	// of them when empty.
+	Hosts []string
+}
+
+// Compression compresses upstream responses the proxy passes on to clients
+// that accept it.
+type Compression struct {
+	Enabled bool
+
+	// Encodings are the content codings to use in order of preference, out
+	// of br, zstd and gzip. All three when empty.
+	Encodings []string
+
+	// ContentTypes are the media types worth compressing, "text/*" style
+	// wildcards included. Common text formats when empty.
+	ContentTypes []string
+
+	// MinSize is the smallest response in bytes that is compressed, 1 KiB
+	// when 0.
+	MinSize int
+}
+
+// Cache is a shared HTTP cache in front of the service.
+type Cache struct {
+	Enabled bool
+
+	// Dir keeps cached responses on disk, in a delne-cache/<service>
+	// directory under it. They are kept in memory when it is empty.
+	Dir string
+
+	// MaxSize is how many bytes of responses are kept, the least recently
+	// used are evicted beyond it. 64 MiB when 0.
+	MaxSize int64
+}
+
+// RetryCondition is a kind of upstream failure a request can be retried on.
+type RetryCondition string
+
+const (
+	RETRY_CONNECT RetryCondition = "connect" // the upstream couldn't be reached
+	RETRY_RESET   RetryCondition = "reset"   // the connection dropped before a response
+	RETRY_TIMEOUT RetryCondition = "timeout" // the upstream took too long to respond
+	RETRY_STATUS  RetryCondition = "5xx"     // the upstream answered 502, 503 or 504
+)
+
+// Retry sends requests that failed to get a response from an upstream again,
+// to another replica when there is one. It is disabled when Attempts is 0.
+type Retry struct {
+	Attempts int // retries after the first try
+
+	// Backoff is the wait before the first retry, doubling for every retry
+	// after it. 100ms when 0.
+	Backoff time.Duration
+
+	// Methods are the request methods that are retried, the idempotent GET,
+	// HEAD, OPTIONS, PUT, DELETE and TRACE when empty.
+	Methods []string
+
+	// On are the failures worth retrying, connect and reset when empty.
+	On []RetryCondition
+
+	// MaxBodySize is the largest request body in bytes that is buffered so it
+	// can be sent again, requests with bigger bodies are not retried. 1 MiB
+	// when 0.
+	MaxBodySize int64
+}
+
+func (r Retry) Enabled() bool {
+	return r.Attempts > 0
+}
+
+// Timeouts bound how long the proxy waits on a service's upstreams and
+// clients. Zero values keep the defaults.
+type Timeouts struct {
+	// Dial is how long connecting to an upstream may take, 30s by default.
+	Dial time.Duration
+	// ResponseHeader is how long an upstream may take to start responding
+	// once it got the request, unlimited by default.
+	ResponseHeader time.Duration
+	// Idle is how long unused connections to upstreams are kept open, 90s by
+	// default.
+	Idle time.Duration
+
+	// Total is how long a request may take from start to end, replacing the
+	// server's read and write timeouts.
+	Total time.Duration
+	// LongLived lifts the server's read and write timeouts without setting a
+	// total, for uploads, long polling and streamed responses.
+	LongLived bool
+
+	// MaxBodySize is the largest request body in bytes, unlimited when 0.
+	MaxBodySize int64
+}
+
+// Streaming configures the WebSocket and other upgraded connections and the
+// event streams the proxy relays for a service.
+type Streaming struct {
+	// PingInterval is how often WebSocket clients are pinged and event
+	// streams sent a comment, which keeps quiet connections from being
+	// dropped along the way. Never when 0.
+	PingInterval time.Duration
+
+	// IdleTimeout closes connections nothing was sent over for this long,
+	// answers to pings included. Never when 0.
+	IdleTimeout time.Duration
+
+	// DrainTimeout is how long connections get to close on their own when
+	// the service is redeployed or stopped, before they are cut. 10s when 0.
+	DrainTimeout time.Duration
+}
+
 type Service struct {
 	ID    int
 	Name  string
 	Hosts []string
+	Kind  ServiceKind
 
-	Status      ServiceStatus
-	ContainerId *string
-	ImageID     *int
-	Network     *string
-	Port        *string
+	Status       ServiceStatus
+	ContainerIds []string
+	ImageID      *int
+	Network      *string
+	Port         *string
 
 	EnvironmentVariables *map[string]string
 
+	RestartPolicy RestartPolicy
+
+	Replicas   int
+	LBStrategy LBStrategy
+
+	HealthCheck    HealthCheck
+	CircuitBreaker CircuitBreaker
+
+	HeaderRules []HeaderRule
+	PathRewrite PathRewrite
+
+	External       ExternalUpstream
+	Redirect       Redirect
+	StaticResponse StaticResponse
+	Files          FileServer
+
+	Maintenance Maintenance
+
+	// ErrorPages replace the proxy's own error pages by status code, e.g.
+	// when the service's upstreams are down.
+	ErrorPages map[int]string
+
+	RateLimits  []RateLimit
+	AccessRules []AccessRule
+	Auth        AuthGate
+	Compression Compression
+	Cache       Cache
+	Retry       Retry
+	Timeouts    Timeouts
+	Streaming   Streaming
+
 	Created time.Time
 }
 
+// IsRunning reports whether the service's containers are supposed to be up.
+func (s *Service) IsRunning() bool {
+	return s.Status == RUNNING || s.Status == DEGRADED
+}
+
+// IsContainer reports whether delne runs containers for the service, as
+// opposed to routing its hosts somewhere else.
+func (s *Service) IsContainer() bool {
+	return s.Kind == KIND_CONTAINER || s.Kind == ""
+}
+
+// IsProxied reports whether the service's requests are proxied to upstreams,
+// which is what health checks and circuit breaking apply to.
+func (s *Service) IsProxied() bool {
+	return s.IsContainer() || s.Kind == KIND_EXTERNAL
+}
+
+// UpstreamUrls are the URLs the service's requests are balanced across.
+func (s *Service) UpstreamUrls() []string {
+	if s.Kind == KIND_EXTERNAL {
+		return []string{s.External.URL}
+	}
+
+	urls := []string{}
+	for i := 0; i < max(s.Replicas, 1); i++ {
+		urls = append(urls, s.ReplicaUrl(i))
+	}
+	return urls
+}
+
 func (s *Service) Url() string {
+	return s.ReplicaUrl(0)
+}
+
+// ReplicaName is the container name of the i-th replica, the first replica
+// keeps the name of the service itself.
+func (s *Service) ReplicaName(i int) string {
+	if i == 0 {
+		return s.Name
+	}
+	return fmt.Sprintf("%s-%d", s.Name, i)
+}
+
+func (s *Service) ReplicaUrl(i int) string {
 	if s.Port == nil {
-		return fmt.Sprintf("http://%s", s.Name)
+		return fmt.Sprintf("http://%s", s.ReplicaName(i))
+	}
+	return fmt.Sprintf("http://%s:%s", s.ReplicaName(i), *s.Port)
+}
+
+// IsReplicaName reports whether a container name belongs to one of the
+// service's replicas, including ones left over from a larger replica count.
+func (s *Service) IsReplicaName(name string) bool {
+	if name == s.Name {
+		return true
+	}
+	suffix, ok := strings.CutPrefix(name, s.Name+"-")
+	if !ok || suffix == "" {
+		return false
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return false
+		}
 	}
-	return fmt.Sprintf("http://%s:%s", s.Name, *s.Port)
+	return true
 }
 
 type ServiceModelInterface interface {
 	Insert(name string, hosts []string, image int, network string) (int, error)
+	InsertRoute(name string, hosts []string, kind ServiceKind) (int, error)
 	Get(id int) (*Service, error)
 	GetAll() ([]*Service, error)
 
 	GetByName(name string) (*Service, error)
+	GetByContainerId(containerId string) (*Service, error)
 
 	UpdateStatus(id int, status ServiceStatus) error
-	UpdateContainerId(id int, containerId string) error
+	UpdateContainerIds(id int, containerIds []string) error
 	UpdatePort(id int, port string) error
 
 	UpdateEnvironmentVariables(id int, envVars map[string]string) error
+	UpdateExternal(id int, external ExternalUpstream) error
+	UpdateRedirect(id int, redirect Redirect) error
+	UpdateStaticResponse(id int, response StaticResponse) error
+	UpdateFiles(id int, files FileServer) error
+	UpdateMaintenance(id int, maintenance Maintenance) error
+	UpdateSettings(s *Service) error
 
 	Delete(id int) error
 }
@@ -76,15 +571,61 @@ func (m *ServiceModel) Insert(name string, hosts []string, image_id int, network
 	return id, nil
 }
 
-func (m *ServiceModel) Get(id int) (*Service, error) {
-	stmt := `SELECT id, name, hosts, status, container_id, image_id, network, port, environment_variables FROM services WHERE id = $1`
-	var s Service
+// InsertRoute inserts a service that doesn't run a container and so has no
+// image or network. It starts out stopped.
+func (m *ServiceModel) InsertRoute(name string, hosts []string, kind ServiceKind) (int, error) {
+	stmt := `INSERT INTO services (name, hosts, kind, network, status, environment_variables, created) VALUES ($1, $2, $3, "", $4, "{}", datetime('now')) RETURNING id`
+	var id int
+	err := m.DB.QueryRow(stmt, name, strings.Join(hosts, ",")+",", kind, STOPPED).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+const serviceColumns = `id, name, hosts, status, container_ids, image_id, network, port, environment_variables, restart_policy, replicas, lb_strategy, health_check, circuit_breaker, header_rules, path_rewrite, kind, external, redirect, static_response, files, maintenance, error_pages, rate_limits, access_rules, auth, compression, cache, retry, timeouts, streaming`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanService(row rowScanner) (*Service, error) {
 	hostsCSV := ""
 	envVarsJSON := ""
-	err := m.DB.QueryRow(stmt, id).Scan(&s.ID, &s.Name, &hostsCSV, &s.Status, &s.ContainerId, &s.ImageID, &s.Network, &s.Port, &envVarsJSON)
+	healthCheckJSON := ""
+	circuitBreakerJSON := ""
+	headerRulesJSON := ""
+	pathRewriteJSON := ""
+	externalJSON := ""
+	redirectJSON := ""
+	staticResponseJSON := ""
+	filesJSON := ""
+	maintenanceJSON := ""
+	errorPagesJSON := ""
+	rateLimitsJSON := ""
+	accessRulesJSON := ""
+	authJSON := ""
+	compressionJSON := ""
+	cacheJSON := ""
+	retryJSON := ""
+	timeoutsJSON := ""
+	streamingJSON := ""
+	var containerIdsCSV *string
+	var s Service
+	err := row.Scan(&s.ID, &s.Name, &hostsCSV, &s.Status, &containerIdsCSV, &s.ImageID, &s.Network, &s.Port, &envVarsJSON, &s.RestartPolicy, &s.Replicas, &s.LBStrategy, &healthCheckJSON, &circuitBreakerJSON, &headerRulesJSON, &pathRewriteJSON, &s.Kind, &externalJSON, &redirectJSON, &staticResponseJSON, &filesJSON, &maintenanceJSON, &errorPagesJSON, &rateLimitsJSON, &accessRulesJSON, &authJSON, &compressionJSON, &cacheJSON, &retryJSON, &timeoutsJSON, &streamingJSON)
 	if err != nil {
 		return nil, err
 	}
+
+	s.ContainerIds = []string{}
+	if containerIdsCSV != nil {
+		for _, id := range strings.Split(*containerIdsCSV, ",") {
+			if id != "" {
+				s.ContainerIds = append(s.ContainerIds, id)
+			}
+		}
+	}
+
 	s.Hosts = []string{}
 	for _, host := range strings.Split(hostsCSV, ",") {
 		if host != "" {
@@ -93,8 +634,39 @@ func (m *ServiceModel) Get(id int) (*Service, error) {
 	}
 
 	s.EnvironmentVariables = &map[string]string{}
-	if envVarsJSON != "" {
-		err = json.Unmarshal([]byte(envVarsJSON), s.EnvironmentVariables)
+	s.HeaderRules = []HeaderRule{}
+	s.ErrorPages = map[int]string{}
+	s.RateLimits = []RateLimit{}
+	s.AccessRules = []AccessRule{}
+	for _, setting := range []struct {
+		json string
+		dest any
+	}{
+		{envVarsJSON, s.EnvironmentVariables},
+		{healthCheckJSON, &s.HealthCheck},
+		{circuitBreakerJSON, &s.CircuitBreaker},
+		{headerRulesJSON, &s.HeaderRules},
+		{pathRewriteJSON, &s.PathRewrite},
+		{externalJSON, &s.External},
+		{redirectJSON, &s.Redirect},
+		{staticResponseJSON, &s.StaticResponse},
+		{filesJSON, &s.Files},
+		{maintenanceJSON, &s.Maintenance},
+		{errorPagesJSON, &s.ErrorPages},
+		{rateLimitsJSON, &s.RateLimits},
+		{accessRulesJSON, &s.AccessRules},
+		{authJSON, &s.Auth},
+		{compressionJSON, &s.Compression},
+		{cacheJSON, &s.Cache},
+		{retryJSON, &s.Retry},
+		{timeoutsJSON, &s.Timeouts},
+		{streamingJSON, &s.Streaming},
+	} {
+		// empty columns keep the zero value
+		if setting.json == "" {
+			continue
+		}
+		err = json.Unmarshal([]byte(setting.json), setting.dest)
 		if err != nil {
 			return nil, err
 		}
@@ -103,8 +675,13 @@ func (m *ServiceModel) Get(id int) (*Service, error) {
 	return &s, nil
 }
 
+func (m *ServiceModel) Get(id int) (*Service, error) {
+	stmt := `SELECT ` + serviceColumns + ` FROM services WHERE id = $1`
+	return scanService(m.DB.QueryRow(stmt, id))
+}
+
 func (m *ServiceModel) GetAll() ([]*Service, error) {
-	stmt := `SELECT id, name, hosts, status, container_id, image_id, network, port, environment_variables FROM services`
+	stmt := `SELECT ` + serviceColumns + ` FROM services`
 	rows, err := m.DB.Query(stmt)
 	if err != nil {
 		return nil, err
@@ -113,31 +690,11 @@ func (m *ServiceModel) GetAll() ([]*Service, error) {
 
 	var services []*Service
 	for rows.Next() {
-
-		hostsCSV := ""
-		envVarsJSON := ""
-
-		var s Service
-		err := rows.Scan(&s.ID, &s.Name, &hostsCSV, &s.Status, &s.ContainerId, &s.ImageID, &s.Network, &s.Port, &envVarsJSON)
+		s, err := scanService(rows)
 		if err != nil {
 			return nil, err
 		}
-		s.Hosts = []string{}
-		for _, host := range strings.Split(hostsCSV, ",") {
-			if host != "" {
-				s.Hosts = append(s.Hosts, host)
-			}
-		}
-
-		s.EnvironmentVariables = &map[string]string{}
-		if envVarsJSON != "" {
-			err = json.Unmarshal([]byte(envVarsJSON), s.EnvironmentVariables)
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		services = append(services, &s)
+		services = append(services, s)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
@@ -146,32 +703,13 @@ func (m *ServiceModel) GetAll() ([]*Service, error) {
 }
 
 func (m *ServiceModel) GetByName(name string) (*Service, error) {
-	stmt := `SELECT id, name, hosts, status, container_id, image_id, network, port, environment_variables FROM services WHERE name = $1`
-
-	hostsCSV := ""
-	envVarsJSON := ""
-	var s Service
-	err := m.DB.QueryRow(stmt, name).Scan(&s.ID, &s.Name, &hostsCSV, &s.Status, &s.ContainerId, &s.ImageID, &s.Network, &s.Port, &envVarsJSON)
-	if err != nil {
-		return nil, err
-	}
-
-	s.Hosts = []string{}
-	for _, host := range strings.Split(hostsCSV, ",") {
-		if host != "" {
-			s.Hosts = append(s.Hosts, host)
-		}
-	}
-
-	s.EnvironmentVariables = &map[string]string{}
-	if envVarsJSON != "" {
-		err = json.Unmarshal([]byte(envVarsJSON), s.EnvironmentVariables)
-		if err != nil {
-			return nil, err
-		}
-	}
+	stmt := `SELECT ` + serviceColumns + ` FROM services WHERE name = $1`
+	return scanService(m.DB.QueryRow(stmt, name))
+}
 
-	return &s, nil
+func (m *ServiceModel) GetByContainerId(containerId string) (*Service, error) {
+	stmt := `SELECT ` + serviceColumns + ` FROM services WHERE instr(',' || container_ids || ',', ',' || $1 || ',') > 0`
+	return scanService(m.DB.QueryRow(stmt, containerId))
 }
 
 func (m *ServiceModel) UpdateStatus(id int, status ServiceStatus) error {
@@ -183,9 +721,9 @@ func (m *ServiceModel) UpdateStatus(id int, status ServiceStatus) error {
 	return nil
 }
 
-func (m *ServiceModel) UpdateContainerId(id int, containerId string) error {
-	stmt := `UPDATE services SET container_id = $1 WHERE id = $2`
-	_, err := m.DB.Exec(stmt, containerId, id)
+func (m *ServiceModel) UpdateContainerIds(id int, containerIds []string) error {
+	stmt := `UPDATE services SET container_ids = $1 WHERE id = $2`
+	_, err := m.DB.Exec(stmt, strings.Join(containerIds, ","), id)
 	if err != nil {
 		return err
 	}
@@ -224,3 +762,102 @@ func (m *ServiceModel) UpdateEnvironmentVariables(id int, envVars map[string]str
 	}
 	return nil
 }
+
+func (m *ServiceModel) UpdateExternal(id int, external ExternalUpstream) error {
+	externalJSON, err := json.Marshal(external)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE services SET external = $1 WHERE id = $2`
+	_, err = m.DB.Exec(stmt, externalJSON, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *ServiceModel) UpdateRedirect(id int, redirect Redirect) error {
+	redirectJSON, err := json.Marshal(redirect)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE services SET redirect = $1 WHERE id = $2`
+	_, err = m.DB.Exec(stmt, redirectJSON, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *ServiceModel) UpdateStaticResponse(id int, response StaticResponse) error {
+	staticResponseJSON, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE services SET static_response = $1 WHERE id = $2`
+	_, err = m.DB.Exec(stmt, staticResponseJSON, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *ServiceModel) UpdateFiles(id int, files FileServer) error {
+	filesJSON, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE services SET files = $1 WHERE id = $2`
+	_, err = m.DB.Exec(stmt, filesJSON, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *ServiceModel) UpdateMaintenance(id int, maintenance Maintenance) error {
+	maintenanceJSON, err := json.Marshal(maintenance)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE services SET maintenance = $1 WHERE id = $2`
+	_, err = m.DB.Exec(stmt, maintenanceJSON, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateSettings stores everything the edit form changes in a single
+// statement, so a failed update leaves none of it applied.
+func (m *ServiceModel) UpdateSettings(s *Service) error {
+	args := []any{s.RestartPolicy, s.Replicas, s.LBStrategy}
+	for _, setting := range []any{
+		s.EnvironmentVariables, s.HealthCheck, s.CircuitBreaker, s.HeaderRules, s.PathRewrite,
+		s.External, s.Redirect, s.StaticResponse, s.Files, s.Maintenance, s.ErrorPages,
+		s.RateLimits, s.AccessRules, s.Auth, s.Compression, s.Cache, s.Retry, s.Timeouts, s.Streaming,
+	} {
+		settingJSON, err := json.Marshal(setting)
+		if err != nil {
+			return err
+		}
+		args = append(args, settingJSON)
+	}
+	args = append(args, s.ID)
+
+	stmt := `UPDATE services SET restart_policy = $1, replicas = $2, lb_strategy = $3,
+	environment_variables = $4, health_check = $5, circuit_breaker = $6, header_rules = $7, path_rewrite = $8,
+	external = $9, redirect = $10, static_response = $11, files = $12, maintenance = $13, error_pages = $14,
+	rate_limits = $15, access_rules = $16, auth = $17, compression = $18, cache = $19, retry = $20, timeouts = $21, streaming = $22
+	WHERE id = $23`
+	_, err := m.DB.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+	return nil
+}
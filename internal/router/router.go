@@ -0,0 +1,300 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tree matches a host and path against registered routes. Routes are keyed on
+// the host and then on whole path segments, so a lookup always returns the
+// most specific route and "/api" never matches "/apiv2".
+//
+// Besides literal hosts a pattern's host can be
+//   - a wildcard like "*.preview.example.com", where each * matches exactly
+//     one label,
+//   - a regular expression prefixed with ~, e.g. "~(?P<tenant>[a-z]+)\.example\.com",
+//     which has to match the whole host and can't contain a "/", as the path
+//     starts at the first one,
+//   - a lone "*", the catch-all used when nothing else matches.
+//
+// Literal hosts win over wildcards, wildcards with more labels win over ones
+// with fewer, and regular expressions are tried last in the lexical order of
+// their patterns, whatever order they were inserted in. If the path has no
+// route under the best host, less specific hosts are tried.
+//
+// A Tree is not safe for concurrent writes; build it once and treat it as
+// read-only afterwards.
+type Tree[T any] struct {
+	hosts     map[string]*node[T]
+	wildcards []*hostPattern[T]
+	regexes   []*hostPattern[T]
+	fallback  *node[T]
+}
+
+type node[T any] struct {
+	children map[string]*node[T]
+	value    T
+	set      bool
+}
+
+type hostPattern[T any] struct {
+	pattern string
+	labels  []string       // wildcards
+	re      *regexp.Regexp // regexes
+	root    *node[T]
+}
+
+func New[T any]() *Tree[T] {
+	return &Tree[T]{hosts: map[string]*node[T]{}}
+}
+
+// ValidPattern reports why pattern can't be inserted, if it can't.
+func ValidPattern(pattern string) error {
+	host, _ := SplitPattern(pattern)
+	switch {
+	case host == "":
+		return errors.New("empty host")
+	case strings.Contains(pattern, ","):
+		// hosts are stored comma separated
+		return fmt.Errorf("invalid host pattern %q: patterns can't contain \",\"", pattern)
+	case strings.HasPrefix(host, "~"):
+		_, err := compileHost(host)
+		if err != nil && strings.Contains(pattern, "/") {
+			if _, whole := regexp.Compile(strings.TrimPrefix(pattern, "~")); whole == nil {
+				return fmt.Errorf("invalid host pattern %q: host expressions can't contain \"/\", the path starts at the first one", pattern)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Insert registers value under pattern, which is a host optionally followed by
+// a path prefix, e.g. "example.com" or "example.com/api". Inserting the same
+// pattern twice replaces the previous value. Patterns that fail ValidPattern
+// are ignored.
+func (t *Tree[T]) Insert(pattern string, value T) {
+	host, path := SplitPattern(pattern)
+
+	n := t.hostNode(host)
+	if n == nil {
+		return
+	}
+
+	for _, seg := range segments(path) {
+		child, ok := n.children[seg]
+		if !ok {
+			child = &node[T]{}
+			if n.children == nil {
+				n.children = map[string]*node[T]{}
+			}
+			n.children[seg] = child
+		}
+		n = child
+	}
+
+	n.value = value
+	n.set = true
+}
+
+// hostNode returns the root node for a host pattern, creating it if needed.
+func (t *Tree[T]) hostNode(host string) *node[T] {
+	switch {
+	case host == "*":
+		if t.fallback == nil {
+			t.fallback = &node[T]{}
+		}
+		return t.fallback
+
+	case strings.HasPrefix(host, "~"):
+		for _, p := range t.regexes {
+			if p.pattern == host {
+				return p.root
+			}
+		}
+		re, err := compileHost(host)
+		if err != nil {
+			return nil
+		}
+		p := &hostPattern[T]{pattern: host, re: re, root: &node[T]{}}
+		t.regexes = append(t.regexes, p)
+		sort.Slice(t.regexes, func(i, j int) bool {
+			return t.regexes[i].pattern < t.regexes[j].pattern
+		})
+		return p.root
+
+	case strings.Contains(host, "*"):
+		for _, p := range t.wildcards {
+			if p.pattern == host {
+				return p.root
+			}
+		}
+		p := &hostPattern[T]{pattern: host, labels: strings.Split(host, "."), root: &node[T]{}}
+		t.wildcards = append(t.wildcards, p)
+		sort.Slice(t.wildcards, func(i, j int) bool {
+			a, b := t.wildcards[i], t.wildcards[j]
+			if len(a.labels) != len(b.labels) {
+				return len(a.labels) > len(b.labels)
+			}
+			if wa, wb := strings.Count(a.pattern, "*"), strings.Count(b.pattern, "*"); wa != wb {
+				return wa < wb
+			}
+			return a.pattern < b.pattern
+		})
+		return p.root
+	}
+
+	n, ok := t.hosts[host]
+	if !ok {
+		n = &node[T]{}
+		t.hosts[host] = n
+	}
+	return n
+}
+
+func compileHost(host string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(`^(?:` + strings.TrimPrefix(host, "~") + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host pattern %q: %w", host, err)
+	}
+	return re, nil
+}
+
+// Match returns the value of the longest registered prefix of host+path along
+// with that prefix and the path remaining after it. Both are built from the
+// path's segments, so repeated slashes are collapsed; the prefix is empty for
+// routes on the host alone and the remaining path always starts with a slash.
+//
+// params holds what wildcard and regex hosts captured: "label" is the first
+// capture, "label1", "label2", ... all of them in order, and named regex
+// groups are also available under their name. It is nil for literal hosts.
+func (t *Tree[T]) Match(host, path string) (value T, prefix, rest string, params map[string]string, ok bool) {
+	host = strings.ToLower(host)
+	segs := segments(path)
+
+	if n, found := t.hosts[host]; found {
+		if value, prefix, rest, ok = matchPath(n, path, segs); ok {
+			return value, prefix, rest, nil, true
+		}
+	}
+
+	labels := strings.Split(host, ".")
+	for _, p := range t.wildcards {
+		captures, found := p.matchLabels(labels)
+		if !found {
+			continue
+		}
+		if value, prefix, rest, ok = matchPath(p.root, path, segs); ok {
+			return value, prefix, rest, captureParams(captures, nil), true
+		}
+	}
+
+	for _, p := range t.regexes {
+		captures := p.re.FindStringSubmatch(host)
+		if captures == nil {
+			continue
+		}
+		if value, prefix, rest, ok = matchPath(p.root, path, segs); ok {
+			return value, prefix, rest, captureParams(captures[1:], p.re.SubexpNames()[1:]), true
+		}
+	}
+
+	if t.fallback != nil {
+		if value, prefix, rest, ok = matchPath(t.fallback, path, segs); ok {
+			return value, prefix, rest, nil, true
+		}
+	}
+
+	var zero T
+	return zero, "", "", nil, false
+}
+
+func (p *hostPattern[T]) matchLabels(labels []string) ([]string, bool) {
+	if len(labels) != len(p.labels) {
+		return nil, false
+	}
+
+	var captures []string
+	for i, label := range p.labels {
+		switch {
+		case label == "*" && labels[i] != "":
+			captures = append(captures, labels[i])
+		case label != labels[i]:
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+func captureParams(captures, names []string) map[string]string {
+	params := map[string]string{}
+	for i, c := range captures {
+		if i == 0 {
+			params["label"] = c
+		}
+		params["label"+strconv.Itoa(i+1)] = c
+		if i < len(names) && names[i] != "" {
+			params[names[i]] = c
+		}
+	}
+	return params
+}
+
+func matchPath[T any](n *node[T], path string, segs []string) (value T, prefix, rest string, ok bool) {
+	matched := -1
+	if n.set {
+		value, matched = n.value, 0
+	}
+
+	for i, seg := range segs {
+		child, found := n.children[seg]
+		if !found {
+			break
+		}
+		n = child
+		if n.set {
+			value, matched = n.value, i+1
+		}
+	}
+
+	if matched < 0 {
+		return value, "", "", false
+	}
+
+	if matched > 0 {
+		prefix = "/" + strings.Join(segs[:matched], "/")
+	}
+	rest = "/" + strings.Join(segs[matched:], "/")
+	if matched < len(segs) && strings.HasSuffix(path, "/") {
+		rest += "/"
+	}
+	return value, prefix, rest, true
+}
+
+// SplitPattern splits a route pattern into its normalized host and path.
+func SplitPattern(pattern string) (host, path string) {
+	host, path, _ = strings.Cut(pattern, "/")
+	return normalizeHost(host), "/" + path
+}
+
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "~") {
+		// lowercasing would change what the expression means, e.g. \D
+		return host
+	}
+	return strings.ToLower(host)
+}
+
+func segments(path string) []string {
+	segs := []string{}
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
@@ -0,0 +1,231 @@
+package router
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	routes := []string{
+		"example.com",
+		"example.com/api",
+		"example.com/api/v2",
+		"foo.local/test",
+		"Mixed.Case.com",
+	}
+
+	tree := New[string]()
+	for _, r := range routes {
+		tree.Insert(r, r)
+	}
+
+	tests := []struct {
+		name  string
+		host  string
+		path  string
+		want  string
+		rest  string
+		found bool
+	}{
+		{name: "host only", host: "example.com", path: "/", want: "example.com", rest: "/", found: true},
+		{name: "host with unmatched path", host: "example.com", path: "/about", want: "example.com", rest: "/about", found: true},
+		{name: "exact path", host: "example.com", path: "/api", want: "example.com/api", rest: "/", found: true},
+		{name: "path with trailing slash", host: "example.com", path: "/api/", want: "example.com/api", rest: "/", found: true},
+		{name: "sub path", host: "example.com", path: "/api/users", want: "example.com/api", rest: "/users", found: true},
+		{name: "sub path keeps trailing slash", host: "example.com", path: "/api/users/", want: "example.com/api", rest: "/users/", found: true},
+		{name: "longest prefix wins", host: "example.com", path: "/api/v2/users", want: "example.com/api/v2", rest: "/users", found: true},
+		{name: "segment boundary", host: "example.com", path: "/apiv2", want: "example.com", rest: "/apiv2", found: true},
+		{name: "partial segment of deeper route", host: "example.com", path: "/api/v20", want: "example.com/api", rest: "/v20", found: true},
+		{name: "path only route", host: "foo.local", path: "/test/page", want: "foo.local/test", rest: "/page", found: true},
+		{name: "path only route without match", host: "foo.local", path: "/other", found: false},
+		{name: "path only route root", host: "foo.local", path: "/", found: false},
+		{name: "unknown host", host: "bar.com", path: "/api", found: false},
+		{name: "host is case insensitive", host: "EXAMPLE.com", path: "/api", want: "example.com/api", rest: "/", found: true},
+		{name: "registered host is normalized", host: "mixed.case.com", path: "/", want: "Mixed.Case.com", rest: "/", found: true},
+		{name: "empty path", host: "example.com", path: "", want: "example.com", rest: "/", found: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, rest, _, found := tree.Match(tt.host, tt.path)
+			if found != tt.found {
+				t.Fatalf("found = %v; want %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("route = %q; want %q", got, tt.want)
+			}
+			if rest != tt.rest {
+				t.Errorf("rest = %q; want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestMatchHostPatterns(t *testing.T) {
+	routes := []string{
+		"app.preview.example.com",
+		"docs.preview.example.com/guide",
+		"*.preview.example.com",
+		"*.*.example.com",
+		"*.preview.example.com/api",
+		`~(?P<tenant>[a-z]+)-(\d+)\.tenants\.com`,
+		"*/fallback",
+		"*",
+	}
+
+	tree := New[string]()
+	for _, r := range routes {
+		if err := ValidPattern(r); err != nil {
+			t.Fatalf("ValidPattern(%q) = %v", r, err)
+		}
+		tree.Insert(r, r)
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		want   string
+		rest   string
+		params map[string]string
+	}{
+		{name: "literal beats wildcard", host: "app.preview.example.com", path: "/", want: "app.preview.example.com", rest: "/"},
+		{name: "wildcard", host: "pr-12.preview.example.com", path: "/x", want: "*.preview.example.com", rest: "/x", params: map[string]string{"label": "pr-12", "label1": "pr-12"}},
+		{name: "wildcard with path", host: "pr-12.preview.example.com", path: "/api/users", want: "*.preview.example.com/api", rest: "/users", params: map[string]string{"label": "pr-12", "label1": "pr-12"}},
+		{name: "literal root beats wildcard path", host: "app.preview.example.com", path: "/api", want: "app.preview.example.com", rest: "/api"},
+		{name: "literal falls through to wildcard", host: "docs.preview.example.com", path: "/api", want: "*.preview.example.com/api", rest: "/", params: map[string]string{"label": "docs", "label1": "docs"}},
+		{name: "fewer wildcards win", host: "a.b.example.com", path: "/", want: "*.*.example.com", rest: "/", params: map[string]string{"label": "a", "label1": "a", "label2": "b"}},
+		{name: "wildcard matches a single label", host: "a.b.preview.example.com", path: "/", want: "*", rest: "/"},
+		{name: "regex", host: "acme-42.tenants.com", path: "/", want: `~(?P<tenant>[a-z]+)-(\d+)\.tenants\.com`, rest: "/", params: map[string]string{"label": "acme", "label1": "acme", "label2": "42", "tenant": "acme"}},
+		{name: "regex is anchored", host: "x.acme-42.tenants.com", path: "/", want: "*", rest: "/"},
+		{name: "catch-all path", host: "unknown.org", path: "/fallback/page", want: "*/fallback", rest: "/page"},
+		{name: "catch-all", host: "unknown.org", path: "/", want: "*", rest: "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, rest, params, found := tree.Match(tt.host, tt.path)
+			if !found {
+				t.Fatal("expected a match")
+			}
+			if got != tt.want {
+				t.Errorf("route = %q; want %q", got, tt.want)
+			}
+			if rest != tt.rest {
+				t.Errorf("rest = %q; want %q", rest, tt.rest)
+			}
+			if len(params) != len(tt.params) {
+				t.Fatalf("params = %v; want %v", params, tt.params)
+			}
+			for k, v := range tt.params {
+				if params[k] != v {
+					t.Errorf("params[%q] = %q; want %q", k, params[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for _, pattern := range []string{"", "/path", "~([a-z]", `~[^/]+\.example\.com`, `~(a/b)\.example\.com/api`, `~[a-z]{1,3}\.example\.com`, "example.com/a,b"} {
+		if ValidPattern(pattern) == nil {
+			t.Errorf("ValidPattern(%q) = nil; want an error", pattern)
+		}
+	}
+	for _, pattern := range []string{"example.com/api", "*.example.com", `~[a-z]+\.example\.com/api`} {
+		if err := ValidPattern(pattern); err != nil {
+			t.Errorf("ValidPattern(%q) = %v; want nil", pattern, err)
+		}
+	}
+}
+
+func TestRegexHostOrder(t *testing.T) {
+	patterns := []string{`~b[a-z]*\.example\.com`, `~[a-z]+\.example\.com`}
+	want := `~[a-z]+\.example\.com` // both match, it sorts first
+
+	for _, order := range [][]string{patterns, {patterns[1], patterns[0]}} {
+		tree := New[string]()
+		for _, r := range order {
+			tree.Insert(r, r)
+		}
+
+		got, _, _, _, found := tree.Match("beta.example.com", "/")
+		if !found {
+			t.Fatal("expected a match")
+		}
+		if got != want {
+			t.Errorf("inserted as %q: route = %q; want %q", order, got, want)
+		}
+	}
+}
+
+func TestMatchPrefix(t *testing.T) {
+	tree := New[string]()
+	for _, r := range []string{"example.com", "example.com/api", "example.com/api/v2"} {
+		tree.Insert(r, r)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		prefix string
+		rest   string
+	}{
+		{name: "host route", path: "/about", prefix: "", rest: "/about"},
+		{name: "root", path: "/", prefix: "", rest: "/"},
+		{name: "path route", path: "/api/users", prefix: "/api", rest: "/users"},
+		{name: "trailing slash", path: "/api/", prefix: "/api", rest: "/"},
+		{name: "deeper route", path: "/api/v2/users/", prefix: "/api/v2", rest: "/users/"},
+		{name: "leading double slash", path: "//api/users", prefix: "/api", rest: "/users"},
+		{name: "double slash inside", path: "/api//v2//users", prefix: "/api/v2", rest: "/users"},
+		{name: "double slash after the prefix", path: "/api//users", prefix: "/api", rest: "/users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, prefix, rest, _, found := tree.Match("example.com", tt.path)
+			if !found {
+				t.Fatal("expected a match")
+			}
+			if prefix != tt.prefix || rest != tt.rest {
+				t.Errorf("Match(%q) = %q, %q; want %q, %q", tt.path, prefix, rest, tt.prefix, tt.rest)
+			}
+		})
+	}
+}
+
+func TestInsertReplaces(t *testing.T) {
+	tree := New[int]()
+	tree.Insert("example.com/api", 1)
+	tree.Insert("example.com/api/", 2)
+
+	got, _, _, _, found := tree.Match("example.com", "/api")
+	if !found {
+		t.Fatal("expected a match")
+	}
+	if got != 2 {
+		t.Errorf("got %d; want 2", got)
+	}
+}
+
+func TestSplitPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		path    string
+	}{
+		{pattern: "example.com", host: "example.com", path: "/"},
+		{pattern: "example.com/", host: "example.com", path: "/"},
+		{pattern: "Example.com/API", host: "example.com", path: "/API"},
+		{pattern: "example.com/a/b", host: "example.com", path: "/a/b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			host, path := SplitPattern(tt.pattern)
+			if host != tt.host || path != tt.path {
+				t.Errorf("SplitPattern(%q) = %q, %q; want %q, %q", tt.pattern, host, path, tt.host, tt.path)
+			}
+		})
+	}
+}
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN restart_policy;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN restart_policy TEXT NOT NULL DEFAULT 'on-failure';
\ No newline at end of file
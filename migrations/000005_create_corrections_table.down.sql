@@ -0,0 +1 @@
+DROP TABLE IF EXISTS corrections;
\ No newline at end of file
@@ -0,0 +1,9 @@
+CREATE TABLE corrections (
+  id INTEGER NOT NULL PRIMARY KEY,
+  -- not a foreign key, corrections outlive the services they were made for
+  service_id INTEGER NOT NULL,
+  service_name TEXT NOT NULL,
+  action TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  created DATETIME NOT NULL
+);
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE services DROP COLUMN lb_strategy;
+ALTER TABLE services DROP COLUMN replicas;
+ALTER TABLE services RENAME COLUMN container_ids TO container_id;
\ No newline at end of file
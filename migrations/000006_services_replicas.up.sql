@@ -0,0 +1,3 @@
+ALTER TABLE services RENAME COLUMN container_id TO container_ids;
+ALTER TABLE services ADD COLUMN replicas INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE services ADD COLUMN lb_strategy TEXT NOT NULL DEFAULT 'round-robin';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN health_check;
\ No newline at end of file
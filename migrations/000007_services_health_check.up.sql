@@ -0,0 +1,2 @@
+-- stringified JSON, same as environment_variables
+ALTER TABLE services ADD COLUMN health_check TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN circuit_breaker;
\ No newline at end of file
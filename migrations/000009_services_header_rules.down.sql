@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN header_rules;
\ No newline at end of file
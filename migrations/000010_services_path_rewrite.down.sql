@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN path_rewrite;
\ No newline at end of file
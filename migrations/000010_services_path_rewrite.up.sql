@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN path_rewrite TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
@@ -0,0 +1,28 @@
+-- services that don't run a container have no image, sqlite can only drop the
+-- NOT NULL constraint by rebuilding the table
+CREATE TABLE services_new (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL,
+  hosts TEXT NOT NULL,
+  status TEXT NOT NULL,
+  container_ids TEXT,
+  image_id INTEGER,
+  network TEXT NOT NULL,
+  port TEXT,
+  environment_variables TEXT NOT NULL,
+  created DATETIME NOT NULL,
+  restart_policy TEXT NOT NULL DEFAULT 'on-failure',
+  replicas INTEGER NOT NULL DEFAULT 1,
+  lb_strategy TEXT NOT NULL DEFAULT 'round-robin',
+  health_check TEXT NOT NULL DEFAULT '{}',
+  circuit_breaker TEXT NOT NULL DEFAULT '{}',
+  header_rules TEXT NOT NULL DEFAULT '[]',
+  path_rewrite TEXT NOT NULL DEFAULT '{}',
+  kind TEXT NOT NULL DEFAULT 'container',
+  external TEXT NOT NULL DEFAULT '{}'
+);
+INSERT INTO services_new (id, name, hosts, status, container_ids, image_id, network, port, environment_variables, created, restart_policy, replicas, lb_strategy, health_check, circuit_breaker, header_rules, path_rewrite)
+SELECT id, name, hosts, status, container_ids, image_id, network, port, environment_variables, created, restart_policy, replicas, lb_strategy, health_check, circuit_breaker, header_rules, path_rewrite FROM services;
+DROP TABLE services;
+ALTER TABLE services_new RENAME TO services;
+CREATE UNIQUE INDEX services_name_idx ON services (name);
\ No newline at end of file
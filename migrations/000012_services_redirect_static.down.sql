@@ -0,0 +1,2 @@
+ALTER TABLE services DROP COLUMN static_response;
+ALTER TABLE services DROP COLUMN redirect;
\ No newline at end of file
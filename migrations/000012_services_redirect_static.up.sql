@@ -0,0 +1,2 @@
+ALTER TABLE services ADD COLUMN redirect TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE services ADD COLUMN static_response TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
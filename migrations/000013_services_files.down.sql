@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN files;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN maintenance;
\ No newline at end of file
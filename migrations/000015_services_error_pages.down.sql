@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN error_pages;
\ No newline at end of file
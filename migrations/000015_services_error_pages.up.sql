@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN error_pages TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN rate_limits;
\ No newline at end of file
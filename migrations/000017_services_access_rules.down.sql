@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN access_rules;
\ No newline at end of file
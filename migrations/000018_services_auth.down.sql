@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN auth;
\ No newline at end of file
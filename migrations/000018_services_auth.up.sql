@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN auth TEXT NOT NULL DEFAULT '{}';
\ No newline at end of file
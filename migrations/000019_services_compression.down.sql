@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN compression;
\ No newline at end of file
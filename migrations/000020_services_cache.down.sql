@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN cache;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN retry;
\ No newline at end of file
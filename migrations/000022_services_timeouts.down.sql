@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN timeouts;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE services DROP COLUMN streaming;
\ No newline at end of file